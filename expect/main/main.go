@@ -0,0 +1,63 @@
+package main
+
+import (
+	"expect"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"vm"
+)
+
+func main() {
+
+	savedGame := flag.Bool("save", false, "load a saved vm instead of the program")
+	jit := flag.Bool("jit", false, "compile hot basic blocks instead of interpreting them")
+	budget := flag.Int("budget", 10000000, "most instructions to run for each expect, 0 for no limit")
+	write := flag.Bool("write", false, "write each snapshot the script saves to a file")
+	quiet := flag.Bool("q", false, "don't print the session transcript")
+	flag.Parse()
+	if len(flag.Args()) != 2 {
+		fmt.Printf("usage expect <program.bin> <script>\n")
+		os.Exit(1)
+	}
+	v := &vm.VM{JIT: *jit}
+	var err error
+	if *savedGame {
+		err = v.LoadVM(flag.Arg(0))
+	} else {
+		err = v.Load(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Printf("load failed %v\n", err)
+		os.Exit(1)
+	}
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		fmt.Printf("error opening script %v\n", err)
+		os.Exit(1)
+	}
+	script, err := expect.Parse(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("%v: %v\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+	var transcript io.Writer = os.Stdout
+	if *quiet {
+		transcript = nil
+	}
+	s := &expect.Session{VM: v, Budget: *budget, Transcript: transcript}
+	if *write {
+		s.Saved = func(name string, c *vm.VM) error {
+			c.Stdout = os.Stderr
+			defer c.Flush()
+			return c.SaveVM(name)
+		}
+	}
+	if err := s.Run(script); err != nil {
+		fmt.Printf("%v: %v\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%v: ok after %v instructions\n", flag.Arg(1), v.Counter)
+}
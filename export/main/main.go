@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"vm"
+)
+
+func main() {
+
+	at := flag.Int("at", -1, "address for the prologue, defaults to the highest run of zero words it fits in")
+	output := flag.String("o", "", "file to write the image to, defaults to <save>.bin")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		fmt.Printf("usage export [-at <addr>] [-o <file.bin>] <save>\n")
+		os.Exit(1)
+	}
+	s, err := vm.ReadSaveFile(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("load failed %v\n", err)
+		os.Exit(1)
+	}
+	if *at < 0 {
+		*at = vm.PrologueAddr(&s.State)
+	}
+	image, err := vm.Image(&s.State, *at)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		*output = flag.Arg(0) + ".bin"
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, image)
+	if err := ioutil.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %v, prologue of %v words at %v\n", *output, vm.PrologueSize(&s.State), *at)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"vm"
+)
+
+const usage = `usage saves <command> [args]
+  list [<save>...]            list the saves given, or all saves in the directory
+  show <save>...              show a save's details and what it looks like there
+  rename <save> <new name>    rename a save file and relabel it
+  tag <save> <tag>...         add tags to a save
+  untag <save> <tag>...       remove tags from a save
+  notes <save> <notes>        set a save's notes
+  rm <save>...                delete saves
+  diff [-data] <save> <save>  compare two saves
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "list":
+		err = list(args)
+	case "show":
+		err = forEach(args, show)
+	case "rename":
+		err = rename(args)
+	case "tag", "untag":
+		err = tag(args, flag.Arg(0) == "untag")
+	case "notes":
+		err = notes(args)
+	case "rm":
+		err = forEach(args, func(fn string, s *vm.Save) error {
+			fmt.Printf("removing %v\n", fn)
+			return os.Remove(fn)
+		})
+	case "diff":
+		err = diff(args)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// forEach reads each named save and calls fn with it.
+func forEach(files []string, fn func(string, *vm.Save) error) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no saves given")
+	}
+	for _, f := range files {
+		s, err := vm.ReadSaveFile(f)
+		if err != nil {
+			return err
+		}
+		if err := fn(f, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func list(files []string) error {
+	quiet := false
+	if len(files) == 0 {
+		infos, err := ioutil.ReadDir(".")
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, info.Name())
+			}
+		}
+		quiet = true
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SAVE\tVERSION\tIP\tSTACK\tINSTRUCTIONS\tTAGS\tROOM\n")
+	for _, f := range files {
+		s, err := vm.ReadSaveFile(f)
+		if err != nil {
+			if quiet {
+				continue
+			}
+			return err
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", f, s.Version, s.State.Ip, len(s.State.Stack), s.Counter,
+			strings.Join(s.Tags, ","), room(look(s)))
+	}
+	return w.Flush()
+}
+
+func show(fn string, s *vm.Save) error {
+	fmt.Printf("%v\n", fn)
+	fmt.Printf("  label:        %v\n", s.Label)
+	fmt.Printf("  created:      %v\n", s.Created)
+	if s.Version == 0 {
+		fmt.Printf("  version:      0 (legacy)\n")
+	} else {
+		fmt.Printf("  version:      %v\n", s.Version)
+		fmt.Printf("  program:      %v\n", s.Program)
+		fmt.Printf("  tags:         %v\n", strings.Join(s.Tags, ", "))
+		fmt.Printf("  notes:        %v\n", s.Notes)
+		fmt.Printf("  instructions: %v\n", s.Counter)
+	}
+	st := s.State
+	fmt.Printf("  ip:           %v\n", st.Ip)
+	fmt.Printf("  registers:    %v\n", st.Registers)
+	fmt.Printf("  stack:        %v\n", st.Stack)
+	fmt.Printf("  look:\n")
+	for _, l := range strings.Split(strings.TrimSpace(look(s)), "\n") {
+		fmt.Printf("    %v\n", l)
+	}
+	return nil
+}
+
+// look runs a copy of the save with the command "look" and returns what it
+// prints before asking for the next command. A save made part way through a
+// line needs a second look.
+func look(s *vm.Save) string {
+	c := &vm.BufferConsole{}
+	v := &vm.VM{Console: c}
+	if err := v.Restore(s); err != nil {
+		return err.Error()
+	}
+	v.OnPrompt = func(v *vm.VM, output string) error {
+		return vm.Prompt
+	}
+	for i := 0; i < 2 && !roomName.MatchString(c.Out.String()); i++ {
+		c.Out.Reset()
+		c.In.WriteString("look\n")
+		if r := v.RunContext(context.Background(), 1000000); r.Reason() != vm.Prompt {
+			break
+		}
+	}
+	return c.Out.String()
+}
+
+var roomName = regexp.MustCompile(`== (.*) ==`)
+
+// room returns the room named in the output of look, or its first line.
+func room(output string) string {
+	if m := roomName.FindStringSubmatch(output); m != nil {
+		return m[1]
+	}
+	return strings.SplitN(strings.TrimSpace(output), "\n", 2)[0]
+}
+
+// rewrite reads a save, changes it and writes it back in the current format.
+func rewrite(fn string, change func(*vm.Save)) error {
+	return rewriteTo(fn, fn, change)
+}
+
+// rewriteTo reads the save in from, changes it and writes it to to in the
+// current format. The save is written to a temporary file first, so that
+// from is never left half written.
+func rewriteTo(from, to string, change func(*vm.Save)) error {
+	s, err := vm.ReadSaveFile(from)
+	if err != nil {
+		return err
+	}
+	if s.Version == 0 {
+		fmt.Printf("converting legacy save %v to version %v\n", from, vm.SaveVersion)
+	}
+	change(s)
+	tmp := to + ".tmp"
+	if err := vm.WriteSaveFile(tmp, s); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, to)
+}
+
+func rename(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage saves rename <save> <new name>")
+	}
+	if _, err := os.Stat(args[1]); err == nil {
+		return fmt.Errorf("%v already exists", args[1])
+	}
+	err := rewriteTo(args[0], args[1], func(s *vm.Save) {
+		s.Label = args[1]
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(args[0])
+}
+
+func tag(args []string, remove bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage saves tag|untag <save> <tag>...")
+	}
+	return rewrite(args[0], func(s *vm.Save) {
+		tags := map[string]bool{}
+		for _, t := range s.Tags {
+			tags[t] = true
+		}
+		for _, t := range args[1:] {
+			tags[t] = !remove
+		}
+		s.Tags = nil
+		for t, ok := range tags {
+			if ok {
+				s.Tags = append(s.Tags, t)
+			}
+		}
+		sort.Strings(s.Tags)
+	})
+}
+
+func notes(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage saves notes <save> <notes>")
+	}
+	return rewrite(args[0], func(s *vm.Save) {
+		s.Notes = strings.Join(args[1:], " ")
+	})
+}
+
+func diff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	data := flags.Bool("data", false, "only show memory the metadata marks as written and never executed")
+	metadataFile := flags.String("metadata", ".metadata", "metadata file for -data")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage saves diff [-data] [-metadata <file>] <save> <save>")
+	}
+	a, err := vm.ReadSaveFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := vm.ReadSaveFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	d := vm.Diff(&a.State, &b.State)
+	if *data {
+		v := &vm.VM{MetadataFile: *metadataFile}
+		v.LoadMetadata()
+		d.Filter(v.IsData)
+	}
+	fmt.Printf("%v", d)
+	if ra, rb := room(look(a)), room(look(b)); ra != rb {
+		fmt.Printf("room: %v -> %v\n", ra, rb)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"vm"
+)
+
+const usage = `usage snapshots [-store <dir>] <command> [args]
+  tree                        show the snapshots as a tree of inputs
+  show <snapshot>             show a snapshot's details
+  import <save> [<parent>]    add a save file to the store
+  get <snapshot> <file>       write a snapshot out as a save file
+  diff <snapshot> <snapshot>  compare two snapshots
+Snapshots are named by id, a unique prefix of one, or label.
+`
+
+func main() {
+	dir := flag.String("store", ".snapshots", "snapshot store directory")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	store, err := vm.OpenStore(*dir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "tree":
+		err = store.Tree(os.Stdout)
+	case "show":
+		err = show(store, args)
+	case "import":
+		err = importSave(store, args)
+	case "get":
+		err = get(store, args)
+	case "diff":
+		err = diff(store, args)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func show(store *vm.Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage snapshots show <snapshot>")
+	}
+	s, id, err := store.Get(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v\n", id)
+	fmt.Printf("  label:        %v\n", s.Label)
+	fmt.Printf("  created:      %v\n", s.Created)
+	fmt.Printf("  parent:       %v\n", s.Parent)
+	fmt.Printf("  input:        %q\n", s.Input)
+	fmt.Printf("  instructions: %v\n", s.Counter)
+	fmt.Printf("  ip:           %v\n", s.State.Ip)
+	fmt.Printf("  registers:    %v\n", s.State.Registers)
+	fmt.Printf("  stack:        %v\n", s.State.Stack)
+	return nil
+}
+
+func importSave(store *vm.Store, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage snapshots import <save> [<parent>]")
+	}
+	s, err := vm.ReadSaveFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if s.Parent, err = store.Resolve(args[1]); err != nil {
+			return err
+		}
+	}
+	id, err := store.Put(s)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v\n", id)
+	return nil
+}
+
+func get(store *vm.Store, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage snapshots get <snapshot> <file>")
+	}
+	s, _, err := store.Get(args[0])
+	if err != nil {
+		return err
+	}
+	return vm.WriteSaveFile(args[1], s)
+}
+
+func diff(store *vm.Store, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage snapshots diff <snapshot> <snapshot>")
+	}
+	a, _, err := store.Get(args[0])
+	if err != nil {
+		return err
+	}
+	b, _, err := store.Get(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v", vm.Diff(&a.State, &b.State))
+	return nil
+}
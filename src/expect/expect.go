@@ -0,0 +1,281 @@
+// Package expect drives a machine through a scripted session: send a line,
+// expect output matching a pattern, branch or fail otherwise, and save
+// snapshots along the way.
+//
+// A script has one command per line. Blank lines and lines starting with #
+// are ignored.
+//
+//	send <text>                          queue a line of input
+//	expect /<regexp>/ [within <n>] [else <label>]
+//	                                     run to the next prompt, at most n
+//	                                     instructions, and match the output,
+//	                                     continuing at label if it doesn't
+//	save <name>                          snapshot the machine as name
+//	label <name>                         mark a place to branch to
+//	goto <label>                         continue at label
+//	fail [<message>]                     stop the script with an error
+package expect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"vm"
+)
+
+// Step is one command of a Script.
+type Step struct {
+	Line   int
+	Cmd    string
+	Arg    string
+	Re     *regexp.Regexp
+	Within int
+	Else   string
+}
+
+// Script is a parsed session script.
+type Script struct {
+	Steps  []Step
+	labels map[string]int
+}
+
+// Parse reads a script, checking that every branch has a label.
+func Parse(r io.Reader) (*Script, error) {
+	s := &Script{labels: map[string]int{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		step := Step{Line: n}
+		step.Cmd, step.Arg = line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			step.Cmd, step.Arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch step.Cmd {
+		case "send", "fail":
+		case "save", "goto":
+			if step.Arg == "" {
+				return nil, fmt.Errorf("line %v: %v needs a name", n, step.Cmd)
+			}
+		case "label":
+			if _, ok := s.labels[step.Arg]; ok || step.Arg == "" {
+				return nil, fmt.Errorf("line %v: bad or repeated label %q", n, step.Arg)
+			}
+			s.labels[step.Arg] = len(s.Steps)
+		case "expect":
+			if err := parseExpect(&step); err != nil {
+				return nil, fmt.Errorf("line %v: %v", n, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %v: unknown command %q", n, step.Cmd)
+		}
+		s.Steps = append(s.Steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, step := range s.Steps {
+		label := step.Else
+		if step.Cmd == "goto" {
+			label = step.Arg
+		}
+		if _, ok := s.labels[label]; label != "" && !ok {
+			return nil, fmt.Errorf("line %v: no label %q", step.Line, label)
+		}
+	}
+	return s, nil
+}
+
+// parseExpect splits "/re/ within n else label" into the step's fields.
+func parseExpect(step *Step) error {
+	arg := step.Arg
+	if len(arg) < 2 || arg[0] != '/' {
+		return fmt.Errorf("expect needs a /regexp/")
+	}
+	end := 1
+	for ; end < len(arg) && arg[end] != '/'; end++ {
+		if arg[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(arg) {
+		return fmt.Errorf("unterminated regexp %v", arg)
+	}
+	re, err := regexp.Compile(strings.Replace(arg[1:end], `\/`, "/", -1))
+	if err != nil {
+		return err
+	}
+	step.Re = re
+	opts := strings.Fields(arg[end+1:])
+	for len(opts) >= 2 {
+		switch opts[0] {
+		case "within":
+			if step.Within, err = strconv.Atoi(opts[1]); err != nil || step.Within <= 0 {
+				return fmt.Errorf("bad instruction count %v", opts[1])
+			}
+		case "else":
+			step.Else = opts[1]
+		default:
+			return fmt.Errorf("unknown option %v", opts[0])
+		}
+		opts = opts[2:]
+	}
+	if len(opts) != 0 {
+		return fmt.Errorf("missing value for %v", opts[0])
+	}
+	return nil
+}
+
+// Error reports an expectation that was not met.
+type Error struct {
+	Line    int
+	Pattern string
+	Output  string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("line %v: expected /%v/: %v", e.Line, e.Pattern, e.Err)
+	}
+	return fmt.Sprintf("line %v: expected /%v/ in %q", e.Line, e.Pattern, e.Output)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Session drives VM, which it gives its own console. Budget is the
+// instruction limit for expectations without a within, 0 for none, and
+// Transcript, if set, receives all the output and the lines sent.
+type Session struct {
+	VM         *vm.VM
+	Budget     int
+	Transcript io.Writer
+	Context    context.Context
+	// Snapshots holds a clone of the machine for each save.
+	Snapshots map[string]*vm.VM
+	// Saved, if set, is called after each save.
+	Saved func(name string, v *vm.VM) error
+
+	console *vm.BufferConsole
+	stopped error
+}
+
+func (s *Session) start() {
+	if s.console != nil {
+		return
+	}
+	s.console = &vm.BufferConsole{}
+	s.VM.Console = s.console
+	s.VM.OnPrompt = func(v *vm.VM, output string) error {
+		return vm.Prompt
+	}
+	if s.Snapshots == nil {
+		s.Snapshots = map[string]*vm.VM{}
+	}
+	if s.Context == nil {
+		s.Context = context.Background()
+	}
+}
+
+// Send queues line as the machine's next line of input.
+func (s *Session) Send(line string) {
+	s.start()
+	s.console.In.WriteString(line + "\n")
+	if s.Transcript != nil {
+		io.WriteString(s.Transcript, line+"\n")
+	}
+}
+
+// Expect runs the machine until it prompts for input, stops, or has run
+// within instructions (Budget if within is 0), and reports whether the output
+// since the last expectation matches re. The output is returned either way,
+// along with the reason the machine stopped if it was not a prompt.
+func (s *Session) Expect(re *regexp.Regexp, within int) (string, bool, error) {
+	s.start()
+	if within == 0 {
+		within = s.Budget
+	}
+	if within == 0 {
+		within = -1
+	}
+	err := s.stopped
+	if err == nil {
+		r := s.VM.RunContext(s.Context, within)
+		if r.Reason() != vm.Prompt {
+			err = r.Err
+		}
+		if r.Reason() == vm.Halted {
+			s.stopped = r.Err
+		}
+	}
+	output := s.output()
+	return output, re.MatchString(output), err
+}
+
+func (s *Session) output() string {
+	output := s.console.Out.String()
+	s.console.Out.Reset()
+	if s.Transcript != nil {
+		io.WriteString(s.Transcript, output)
+	}
+	return output
+}
+
+// Save snapshots the machine as name. The snapshot has no console of its own.
+func (s *Session) Save(name string) error {
+	s.start()
+	c := s.VM.Clone()
+	c.Console = nil
+	c.OnPrompt = nil
+	s.Snapshots[name] = c
+	if s.Saved != nil {
+		return s.Saved(name, c)
+	}
+	return nil
+}
+
+// branches reports whether an unmet expectation that stopped with err may
+// take its else branch rather than fail.
+func branches(err error) bool {
+	return err == nil || errors.Is(err, vm.Halted) || errors.Is(err, vm.BudgetExhausted) || errors.Is(err, vm.InputExhausted)
+}
+
+// Run executes script, returning an *Error for the first unmet expectation
+// that has no else branch.
+func (s *Session) Run(script *Script) error {
+	for pc := 0; pc < len(script.Steps); pc++ {
+		step := &script.Steps[pc]
+		switch step.Cmd {
+		case "send":
+			s.Send(step.Arg)
+		case "expect":
+			output, ok, err := s.Expect(step.Re, step.Within)
+			if ok {
+				continue
+			}
+			if step.Else != "" && branches(err) {
+				pc = script.labels[step.Else]
+				continue
+			}
+			return &Error{Line: step.Line, Pattern: step.Re.String(), Output: output, Err: err}
+		case "save":
+			if err := s.Save(step.Arg); err != nil {
+				return fmt.Errorf("line %v: %v", step.Line, err)
+			}
+		case "goto":
+			pc = script.labels[step.Arg]
+		case "fail":
+			return fmt.Errorf("line %v: fail %v", step.Line, step.Arg)
+		}
+	}
+	return nil
+}
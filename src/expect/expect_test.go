@@ -0,0 +1,86 @@
+package expect
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"vm"
+)
+
+func newSession(t *testing.T) *Session {
+	v := &vm.VM{}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	return &Session{VM: v, Budget: 10000000}
+}
+
+func TestTabletScript(t *testing.T) {
+	f, err := os.Open("../../expect/scripts/tablet.expect")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	script, err := Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSession(t)
+	if err := s.Run(script); err != nil {
+		t.Fatal(err)
+	}
+	if s.Snapshots["tablet"] == nil {
+		t.Errorf("no tablet snapshot")
+	}
+}
+
+func TestBranches(t *testing.T) {
+	script, err := Parse(strings.NewReader(`
+expect /Foothills/
+send doorway
+expect /Treasure/ within 100000 else doorway
+fail found treasure
+label doorway
+send look
+expect /nothing/ within 10 else budget
+fail ran forever
+label budget
+expect /Dark cave/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newSession(t).Run(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	script, err := Parse(strings.NewReader("expect /Foothills/ within 1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newSession(t).Run(script)
+	var e *Error
+	if !errors.As(err, &e) || e.Line != 1 || !errors.Is(err, vm.BudgetExhausted) {
+		t.Errorf("got %v, want a budget failure on line 1", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, script := range []string{
+		"expect Foothills",
+		"expect /Foothills",
+		"expect /Foothills/ within",
+		"expect /Foothills/ within x",
+		"expect /x/ else nowhere",
+		"goto nowhere",
+		"label a\nlabel a",
+		"jump a",
+	} {
+		if _, err := Parse(strings.NewReader(script)); err == nil {
+			t.Errorf("%q parsed", script)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"vm"
+)
+
+// Search runs every candidate input against a fork of Start, in parallel, and
+// collects the candidates whose run satisfies Success.
+type Search struct {
+	Start      *vm.VM
+	Candidates <-chan []string
+	Success    func(output string, v *vm.VM) bool
+	Workers    int
+	// Budget, if positive, is the most instructions a candidate may run for
+	// before it is abandoned with reason BudgetExhausted.
+	Budget int
+	// Context, if set, cancels the whole search.
+	Context context.Context
+	// Save, if set, is the name winners are saved under with SaveVM.
+	Save string
+	// Found, if set, is called with each winner as it is found.
+	Found func(Result)
+}
+
+// Result is the outcome of running one candidate.
+type Result struct {
+	Input  []string
+	Output string
+	VM     *vm.VM
+	Err    error
+}
+
+type job struct {
+	input []string
+	v     *vm.VM
+	out   *bytes.Buffer
+}
+
+// Run searches until Candidates is closed or Context is done and returns the
+// winners. Candidates that run out of budget are still offered to Success,
+// with Err set. Once Context is done, the rest of Candidates is read and
+// dropped so that its producer can finish.
+func (s *Search) Run() []Result {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	budget := s.Budget
+	if budget <= 0 {
+		budget = -1
+	}
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	jobs := make(chan job)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				err := j.v.RunContext(ctx, budget).Err
+				if errors.Is(err, vm.InputExhausted) || errors.Is(err, vm.Halted) {
+					err = nil
+				}
+				results <- Result{Input: j.input, Output: j.out.String(), VM: j.v, Err: err}
+			}
+		}()
+	}
+	// Forking touches Start, so it is only done from this goroutine.
+	go func() {
+	dispatch:
+		for input := range s.Candidates {
+			if ctx.Err() != nil {
+				break
+			}
+			out := &bytes.Buffer{}
+			in := strings.Join(input, "\n") + "\n"
+			select {
+			case jobs <- job{input, s.Start.Fork(strings.NewReader(in), out), out}:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		go func() {
+			for range s.Candidates {
+			}
+		}()
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	var winners []Result
+	for r := range results {
+		if !s.Success(r.Output, r.VM) {
+			continue
+		}
+		if s.Save != "" {
+			if err := r.VM.SaveVM(s.Save); err != nil && r.Err == nil {
+				r.Err = err
+			}
+		}
+		if s.Found != nil {
+			s.Found(r)
+		}
+		winners = append(winners, r)
+	}
+	return winners
+}
+
+// Contains is a Success predicate matching output that contains substr.
+func Contains(substr string) func(string, *vm.VM) bool {
+	return func(output string, v *vm.VM) bool {
+		return strings.Contains(output, substr)
+	}
+}
+
+// Permutations generates every ordering of items.
+func Permutations(items []string) <-chan []string {
+	r := make(chan []string)
+	x := append([]string(nil), items...)
+	go func() {
+		permute(x, 0, r)
+		close(r)
+	}()
+	return r
+}
+
+func permute(x []string, y int, r chan []string) {
+	if y == len(x) {
+		z := make([]string, len(x))
+		copy(z, x)
+		r <- z
+		return
+	}
+	for c := y; c < len(x); c++ {
+		x[y], x[c] = x[c], x[y]
+		permute(x, y+1, r)
+		x[y], x[c] = x[c], x[y]
+	}
+}
+
+// Format turns each candidate into input lines by formatting every element
+// with format.
+func Format(format string, in <-chan []string) <-chan []string {
+	r := make(chan []string)
+	go func() {
+		for c := range in {
+			lines := make([]string, len(c))
+			for i, v := range c {
+				lines[i] = fmt.Sprintf(format, v)
+			}
+			r <- lines
+		}
+		close(r)
+	}()
+	return r
+}
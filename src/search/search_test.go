@@ -0,0 +1,69 @@
+package search
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"vm"
+)
+
+func TestPermutations(t *testing.T) {
+	seen := map[string]bool{}
+	for p := range Permutations([]string{"a", "b", "c", "d"}) {
+		seen[strings.Join(p, "")] = true
+	}
+	if len(seen) != 24 {
+		t.Errorf("got %v distinct permutations, want 24", len(seen))
+	}
+}
+
+func TestSearchCoins(t *testing.T) {
+	start := &vm.VM{}
+	if err := start.LoadVM("../../save-2015-12-02T09:42:55-05:00"); err != nil {
+		t.Skip(err)
+	}
+	s := &Search{
+		Start:      start,
+		Candidates: Format("use %v coin", Permutations([]string{"red", "corroded", "shiny", "concave", "blue"})),
+		Success:    Contains("click"),
+		Workers:    4,
+	}
+	winners := s.Run()
+	if len(winners) != 1 {
+		t.Fatalf("got %v winners, want 1", len(winners))
+	}
+	want := "use blue coin,use red coin,use shiny coin,use concave coin,use corroded coin"
+	if got := strings.Join(winners[0].Input, ","); got != want {
+		t.Errorf("winner %v, want %v", got, want)
+	}
+}
+
+func TestCancelledSearchDrainsCandidates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	candidates := make(chan []string)
+	finished := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			candidates <- []string{"look"}
+		}
+		close(candidates)
+		close(finished)
+	}()
+	s := &Search{
+		Start:      &vm.VM{Registers: make([]uint16, 8), Mem: make([]uint16, vm.MemSize)},
+		Candidates: candidates,
+		Success: func(string, *vm.VM) bool {
+			t.Errorf("candidate run after the search was cancelled")
+			return false
+		},
+		Context: ctx,
+	}
+	s.Run()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("candidate producer still blocked after the search")
+	}
+}
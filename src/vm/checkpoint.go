@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// A checkpoint is a clone of the machine taken as the program starts reading
+// a line, with what it printed since the previous checkpoint.
+type checkpoint struct {
+	vm     *VM
+	output string
+}
+
+// checkpoint is called by In and adds a checkpoint of the current state to
+// the ring, dropping the oldest once there are Checkpoints of them.
+func (vm *VM) checkpoint() {
+	vm.checkpointed = true
+	c := checkpoint{vm: vm.Clone(), output: string(vm.turn)}
+	c.vm.Ip -= 2 // back to the In, which has already moved Ip past itself
+	vm.turn = vm.turn[:0]
+	if n := len(vm.ring) - vm.Checkpoints + 1; n > 0 {
+		vm.ring = append(vm.ring[:0], vm.ring[n:]...)
+	}
+	vm.ring = append(vm.ring, c)
+}
+
+// Turns returns the number of turns that can be undone.
+func (vm *VM) Turns() int {
+	if len(vm.ring) == 0 {
+		return 0
+	}
+	return len(vm.ring) - 1
+}
+
+// Undo rolls the machine back n turns, to the checkpoint taken as the program
+// started reading the nth line before the current one, and returns what the
+// program printed leading up to it. Counter keeps counting.
+func (vm *VM) Undo(n int) (string, error) {
+	if vm.Turns() == 0 {
+		return "", fmt.Errorf("nothing to undo")
+	}
+	if n < 1 || n > vm.Turns() {
+		return "", fmt.Errorf("can undo 1 to %v turns", vm.Turns())
+	}
+	c := vm.ring[len(vm.ring)-1-n]
+	vm.ring = vm.ring[:len(vm.ring)-n]
+	vm.rewind(c.vm)
+	return c.output, nil
+}
+
+// rewind puts the machine back in the state of the clone c, which is left
+// unchanged so that it can be rewound to again.
+func (vm *VM) rewind(c *VM) {
+	vm.setState(c)
+	vm.ClearJournal()
+	vm.output = append(vm.output[:0], c.output...)
+	vm.turn = vm.turn[:0]
+	vm.pending = nil
+	vm.midLine = c.midLine
+	vm.prompted = c.prompted
+	vm.checkpointed = c.checkpointed
+	vm.Head = c.Head
+	vm.input = append(vm.input[:0], c.input...)
+	vm.prepare()
+}
+
+// setState copies the state of the clone c, sharing its Mem copy-on-write.
+func (vm *VM) setState(c *VM) {
+	vm.Invalidate()
+	vm.State = State{
+		Mem:       c.Mem,
+		Registers: append([]uint16(nil), c.Registers...),
+		Stack:     append(make([]uint16, 0, cap(c.Stack)), c.Stack...),
+		CallStack: append([]uint16(nil), c.CallStack...),
+		Ip:        c.Ip,
+	}
+	vm.memShared = true
+}
@@ -0,0 +1,55 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUndoEcho(t *testing.T) {
+	out := &bytes.Buffer{}
+	v := newEcho(&ScriptConsole{Lines: []string{"a", "b", "!undo", "c", "!undo 5", "!undo x"}, Out: out})
+	v.Checkpoints = 10
+	v.Escape = "!"
+	if r := v.RunN(-1); r.Reason() != InputExhausted {
+		t.Fatalf("stopped with %v", r.Err)
+	}
+	want := "a\nb\na\nc\ncan undo 1 to 2 turns\nusage !undo [<turns>]\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}
+
+func TestUndoRing(t *testing.T) {
+	v := newEcho(&ScriptConsole{Lines: []string{"a", "b", "c", "d"}})
+	v.Checkpoints = 3
+	v.RunN(-1)
+	if v.Turns() != 2 {
+		t.Fatalf("%v turns to undo, want 2", v.Turns())
+	}
+	if _, err := v.Undo(2); err != nil {
+		t.Fatal(err)
+	}
+	if v.Turns() != 0 {
+		t.Errorf("%v turns left after undo, want 0", v.Turns())
+	}
+}
+
+func TestUndoGame(t *testing.T) {
+	c := &BufferConsole{}
+	v := &VM{Console: c, Checkpoints: 10, Escape: "!"}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	c.In.WriteString("take tablet\n!undo\ninv\n")
+	v.RunN(-1)
+	out := c.Out.String()
+	if !strings.Contains(out, "Taken.") {
+		t.Fatalf("tablet not taken:\n%v", out)
+	}
+	undone := out[strings.LastIndex(out, "Taken."):]
+	inv := undone[strings.Index(undone, "Your inventory:"):]
+	if !strings.Contains(undone, "Foothills") || strings.Contains(inv, "tablet") {
+		t.Errorf("undo did not put the tablet back:\n%v", undone)
+	}
+}
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"io"
+)
+
+// Clone returns an independent copy of the machine at its current point. The
+// registers, stacks, breakpoints and hooks are copied, while Mem is shared
+// copy-on-write: whichever machine first writes to it while running takes a
+// private copy. The clone records no metadata but shares the console with vm,
+// so clones that run in parallel need consoles of their own, as Fork gives
+// them.
+func (vm *VM) Clone() *VM {
+	vm.memShared = true
+	vm.flushCompiled()
+	c := &VM{
+		State: State{
+			Mem:       vm.Mem,
+			Registers: append([]uint16(nil), vm.Registers...),
+			Stack:     append(make([]uint16, 0, cap(vm.Stack)), vm.Stack...),
+			CallStack: append([]uint16(nil), vm.CallStack...),
+			Ip:        vm.Ip,
+		},
+		Program:      vm.Program,
+		MetadataFile: vm.MetadataFile,
+		SaveOnEOF:    vm.SaveOnEOF,
+		Break:        copyBreaks(vm.Break),
+		BreakOps:     copyBreaks(vm.BreakOps),
+		Stdout:       vm.Stdout,
+		Stdin:        vm.Stdin,
+		Console:      vm.Console,
+		Counter:      vm.Counter,
+		JIT:          vm.JIT,
+		Checkpoints:  vm.Checkpoints,
+		Escape:       vm.Escape,
+		Journal:      vm.Journal,
+		OnPrompt:     vm.OnPrompt,
+		Store:        vm.Store,
+		Head:         vm.Head,
+		memShared:    true,
+		output:       append([]byte(nil), vm.output...),
+		midLine:      vm.midLine,
+		prompted:     vm.prompted,
+		input:        append([]byte(nil), vm.input...),
+		checkpointed: vm.checkpointed,
+		pending:      append([]byte(nil), vm.pending...),
+	}
+	for addr, fn := range vm.hooks {
+		c.Hook(addr, fn)
+	}
+	return c
+}
+
+// Fork is Clone with the clone reading from stdin and writing to stdout.
+func (vm *VM) Fork(stdin io.Reader, stdout io.Writer) *VM {
+	c := vm.Clone()
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Console = nil
+	return c
+}
+
+// OwnMem gives vm a private copy of Mem if it is shared with a clone. It must
+// be called before writing to Mem directly.
+func (vm *VM) OwnMem() {
+	if !vm.memShared {
+		return
+	}
+	vm.Mem = append(make([]uint16, 0, MemSize), vm.Mem...)
+	vm.memShared = false
+	vm.codeMem = first(vm.Mem)
+	vm.flushCompiled()
+}
+
+// flushCompiled drops the compiled blocks, which hold pointers into Mem.
+func (vm *VM) flushCompiled() {
+	if vm.blocks != nil {
+		vm.blocks = nil
+		vm.heat = nil
+		vm.covered = nil
+		vm.smc = true
+	}
+}
+
+func copyBreaks(m map[uint16]bool) map[uint16]bool {
+	if m == nil {
+		return nil
+	}
+	c := make(map[uint16]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
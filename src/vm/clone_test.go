@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCloneCopyOnWrite(t *testing.T) {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize)}
+	copy(v.Mem, []uint16{
+		16, 100, 32768, // wmem 100 R0
+		0, // halt
+	})
+	v.Registers[0] = 1
+	c := v.Clone()
+	c.Registers[0] = 2
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v.Mem[100] != 0 || c.Mem[100] != 2 {
+		t.Fatalf("after clone ran: parent %v, clone %v", v.Mem[100], c.Mem[100])
+	}
+	if err := v.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v.Mem[100] != 1 || c.Mem[100] != 2 {
+		t.Fatalf("after parent ran: parent %v, clone %v", v.Mem[100], c.Mem[100])
+	}
+}
+
+func TestForkInParallel(t *testing.T) {
+	v := &VM{Stdout: &bytes.Buffer{}, Stdin: bufio.NewReader(strings.NewReader(""))}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	v.Run()
+	commands := []string{"look\n", "take tablet\n", "inv\n", "south\n"}
+	outputs := make([]*bytes.Buffer, len(commands))
+	var wg sync.WaitGroup
+	for i, command := range commands {
+		outputs[i] = &bytes.Buffer{}
+		f := v.Fork(bufio.NewReader(strings.NewReader(command)), outputs[i])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Run()
+		}()
+	}
+	wg.Wait()
+	for i, command := range commands {
+		want := &bytes.Buffer{}
+		f := v.Fork(bufio.NewReader(strings.NewReader(command)), want)
+		f.Run()
+		if outputs[i].String() != want.String() {
+			t.Errorf("%q: parallel fork printed\n%v\nwant\n%v", command, outputs[i], want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Registers as operands.
+const (
+	r0 = 32768 + iota
+	r1
+	r2
+)
+
+// conformanceCases are small hand-assembled programs for every entry of Ops,
+// after the examples and rules in arch-spec. Each runs from 0 with the given
+// registers, stack and input, and is checked against the stop reason, Ip,
+// registers, stack, memory cells and output it should leave. The ip is the
+// address of the instruction it stopped on.
+var conformanceCases = []struct {
+	name  string
+	prog  []uint16
+	regs  []uint16
+	stack []uint16
+	input string
+
+	reason StopReason
+	ip     uint16
+	want   []uint16 // registers, from R0
+	wstack []uint16
+	mem    map[uint16]uint16
+	out    string
+}{
+	{name: "arch-spec example", prog: []uint16{9, r0, r1, 4, 19, r0, 0}, regs: []uint16{0, 65},
+		reason: Halted, ip: 6, want: []uint16{69, 65}, out: "E"},
+
+	{name: "halt", prog: []uint16{0, 21}, reason: Halted, ip: 0},
+
+	{name: "set literal", prog: []uint16{1, r0, 123, 0}, reason: Halted, ip: 3, want: []uint16{123}},
+	{name: "set register", prog: []uint16{1, r2, r1, 0}, regs: []uint16{0, 7},
+		reason: Halted, ip: 3, want: []uint16{0, 7, 7}},
+
+	{name: "push pop", prog: []uint16{2, 5, 2, r0, 3, r1, 3, r2, 0}, regs: []uint16{9},
+		reason: Halted, ip: 8, want: []uint16{9, 9, 5}, wstack: []uint16{}},
+	{name: "pop to memory", prog: []uint16{3, 100, 0}, stack: []uint16{1, 42},
+		reason: Halted, ip: 2, wstack: []uint16{1}, mem: map[uint16]uint16{100: 42}},
+	{name: "pop empty stack", prog: []uint16{21, 3, r0, 0}, regs: []uint16{4},
+		reason: StackUnderflow, ip: 1, want: []uint16{4}},
+
+	{name: "eq true", prog: []uint16{4, r0, r1, 3, 0}, regs: []uint16{9, 3}, reason: Halted, ip: 4, want: []uint16{1, 3}},
+	{name: "eq false", prog: []uint16{4, r0, 2, 3, 0}, regs: []uint16{9}, reason: Halted, ip: 4, want: []uint16{0}},
+	{name: "eq register with itself", prog: []uint16{4, r0, r0, r0, 0}, regs: []uint16{9}, reason: Halted, ip: 4, want: []uint16{1}},
+	{name: "gt true", prog: []uint16{5, r0, 4, 3, 0}, reason: Halted, ip: 4, want: []uint16{1}},
+	{name: "gt equal", prog: []uint16{5, r0, 3, 3, 0}, regs: []uint16{9}, reason: Halted, ip: 4, want: []uint16{0}},
+	{name: "gt false", prog: []uint16{5, r0, r1, 32767, 0}, regs: []uint16{9, 2}, reason: Halted, ip: 4, want: []uint16{0, 2}},
+
+	{name: "jmp literal", prog: []uint16{6, 3, 0, 0}, reason: Halted, ip: 3},
+	{name: "jmp register", prog: []uint16{6, r0, 0, 21, 0}, regs: []uint16{3}, reason: Halted, ip: 4, want: []uint16{3}},
+	{name: "jt nonzero", prog: []uint16{7, 32767, 4, 0, 0}, reason: Halted, ip: 4},
+	{name: "jt zero", prog: []uint16{7, r0, 4, 0, 0}, reason: Halted, ip: 3},
+	{name: "jf zero", prog: []uint16{8, 0, r1, 0, 21, 0}, regs: []uint16{0, 4}, reason: Halted, ip: 5, want: []uint16{0, 4}},
+	{name: "jf nonzero", prog: []uint16{8, 1, 4, 0, 0}, reason: Halted, ip: 3},
+
+	{name: "add", prog: []uint16{9, r0, 2, 3, 0}, reason: Halted, ip: 4, want: []uint16{5}},
+	{name: "add wraps", prog: []uint16{9, r0, 32758, 15, 0}, reason: Halted, ip: 4, want: []uint16{5}},
+	{name: "add largest", prog: []uint16{9, r0, 32767, 32767, 0}, reason: Halted, ip: 4, want: []uint16{32766}},
+	{name: "add register to itself", prog: []uint16{9, r0, r0, r0, 0}, regs: []uint16{20000}, reason: Halted, ip: 4, want: []uint16{7232}},
+	{name: "add to memory", prog: []uint16{9, 100, 1, 2, 0}, reason: Halted, ip: 4, mem: map[uint16]uint16{100: 3}},
+	{name: "mult", prog: []uint16{10, r0, 6, 7, 0}, reason: Halted, ip: 4, want: []uint16{42}},
+	{name: "mult wraps", prog: []uint16{10, r0, 16384, 2, 0}, regs: []uint16{9}, reason: Halted, ip: 4, want: []uint16{0}},
+	{name: "mult largest", prog: []uint16{10, r0, r1, r1, 0}, regs: []uint16{0, 32767}, reason: Halted, ip: 4, want: []uint16{1, 32767}},
+	{name: "mod", prog: []uint16{11, r0, 32767, 10, 0}, reason: Halted, ip: 4, want: []uint16{7}},
+	{name: "mod by zero", prog: []uint16{11, r0, 5, r1, 0}, regs: []uint16{9}, reason: DivideByZero, ip: 0, want: []uint16{9}},
+	{name: "and", prog: []uint16{12, r0, 12, 10, 0}, reason: Halted, ip: 4, want: []uint16{8}},
+	{name: "or", prog: []uint16{13, r0, 12, 10, 0}, reason: Halted, ip: 4, want: []uint16{14}},
+	{name: "not zero", prog: []uint16{14, r0, 0, 0}, reason: Halted, ip: 3, want: []uint16{32767}},
+	{name: "not is 15 bit", prog: []uint16{14, r0, r1, 0}, regs: []uint16{0, 32767}, reason: Halted, ip: 3, want: []uint16{0, 32767}},
+	{name: "not pattern", prog: []uint16{14, r0, 0x5555, 0}, reason: Halted, ip: 3, want: []uint16{0x2AAA}},
+
+	{name: "rmem literal", prog: []uint16{15, r0, 3, 77}, reason: BadOpcode, ip: 3, want: []uint16{77}},
+	{name: "rmem register", prog: []uint16{15, r0, r0, 0, 0, 55}, regs: []uint16{5}, reason: Halted, ip: 3, want: []uint16{55}},
+	{name: "rmem into memory", prog: []uint16{15, 100, 0, 0}, reason: Halted, ip: 3, mem: map[uint16]uint16{100: 15}},
+	{name: "wmem literal", prog: []uint16{16, 100, r0, 0}, regs: []uint16{8}, reason: Halted, ip: 3, want: []uint16{8}, mem: map[uint16]uint16{100: 8}},
+	{name: "wmem register", prog: []uint16{16, r0, 9, 0}, regs: []uint16{100}, reason: Halted, ip: 3, want: []uint16{100}, mem: map[uint16]uint16{100: 9}},
+	{name: "wmem own code", prog: []uint16{16, 3, 19, 0, 65, 0}, reason: Halted, ip: 5, out: "A"},
+
+	{name: "call literal", prog: []uint16{17, 3, 0, 0}, reason: Halted, ip: 3, wstack: []uint16{2}},
+	{name: "call register", prog: []uint16{17, r0, 0, 0}, regs: []uint16{3}, reason: Halted, ip: 3, want: []uint16{3}, wstack: []uint16{2}},
+	{name: "call ret", prog: []uint16{17, 4, 0, 0, 19, 66, 18}, reason: Halted, ip: 2, wstack: []uint16{}, out: "B"},
+	{name: "ret to stack", prog: []uint16{18, 0, 0, 0}, stack: []uint16{7, 3}, reason: Halted, ip: 3, wstack: []uint16{7}},
+	{name: "ret empty stack halts", prog: []uint16{21, 18, 0}, reason: Halted, ip: 1},
+
+	{name: "out literal", prog: []uint16{19, 104, 19, 105, 19, 10, 0}, reason: Halted, ip: 6, out: "hi\n"},
+	{name: "out register", prog: []uint16{19, r1, 0}, regs: []uint16{0, 122}, reason: Halted, ip: 2, want: []uint16{0, 122}, out: "z"},
+	{name: "in", prog: []uint16{20, r0, 20, r1, 0}, input: "ok", reason: Halted, ip: 4, want: []uint16{'o', 'k'}},
+	{name: "in at end of input", prog: []uint16{20, r0, 20, r1, 0}, input: "x", reason: InputExhausted, ip: 2, want: []uint16{'x'}},
+
+	{name: "noop", prog: []uint16{21, 21, 0}, reason: Halted, ip: 2},
+
+	{name: "bad opcode", prog: []uint16{21, 22}, reason: BadOpcode, ip: 1},
+	{name: "invalid operand", prog: []uint16{1, 32776, 0}, reason: InvalidOperand, ip: 0},
+	{name: "invalid register source", prog: []uint16{19, 32776}, reason: InvalidOperand, ip: 0},
+}
+
+// compileAt makes ip hot enough that the JIT compiles it on the next run.
+func compileAt(v *VM, ip uint16) {
+	v.prepare()
+	for i := 0; i < jitThreshold; i++ {
+		v.block(ip)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	covered := map[string]bool{}
+	for _, c := range conformanceCases {
+		for _, jit := range []bool{false, true} {
+			name := c.name
+			if jit {
+				name += " (jit)"
+			}
+			out := &bytes.Buffer{}
+			v := &VM{
+				State:   State{Mem: make([]uint16, MemSize), Registers: make([]uint16, 8)},
+				JIT:     jit,
+				Console: NewConsole(strings.NewReader(c.input), out),
+			}
+			copy(v.Mem, c.prog)
+			copy(v.Registers, c.regs)
+			v.Stack = append([]uint16(nil), c.stack...)
+			if jit {
+				compileAt(v, 0)
+			}
+			r := v.RunN(1000)
+			var stop *StopError
+			if !errors.As(r.Err, &stop) || stop.Reason != c.reason || stop.Ip != c.ip {
+				t.Errorf("%v: stopped with %v, want %v at %v", name, r.Err, c.reason, c.ip)
+			}
+			want := make([]uint16, 8)
+			copy(want, c.want)
+			if fmt.Sprint(v.Registers) != fmt.Sprint(want) {
+				t.Errorf("%v: registers %v, want %v", name, v.Registers, want)
+			}
+			if c.wstack == nil {
+				c.wstack = c.stack
+			}
+			if fmt.Sprint(v.Stack) != fmt.Sprint(c.wstack) {
+				t.Errorf("%v: stack %v, want %v", name, v.Stack, c.wstack)
+			}
+			for addr, w := range c.mem {
+				if v.Mem[addr] != w {
+					t.Errorf("%v: Mem[%v] = %v, want %v", name, addr, v.Mem[addr], w)
+				}
+			}
+			if out.String() != c.out {
+				t.Errorf("%v: printed %q, want %q", name, out, c.out)
+			}
+			for ip := 0; ip < len(c.prog); {
+				o := c.prog[ip]
+				if int(o) >= len(Ops) {
+					break
+				}
+				covered[Ops[o].Name] = true
+				ip += 1 + len(Ops[o].Args)
+			}
+		}
+	}
+	for _, op := range Ops {
+		if !covered[op.Name] {
+			t.Errorf("no conformance case for %v", op.Name)
+		}
+	}
+}
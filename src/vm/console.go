@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Console is the device behind the In and Out instructions. Output may be
+// buffered until Flush; the machine flushes whenever a run stops.
+type Console interface {
+	ReadByte() (byte, error)
+	WriteByte(c byte) error
+	Write(p []byte) (int, error)
+	Flush() error
+}
+
+// console returns vm.Console, making one from Stdin and Stdout if it is unset.
+func (vm *VM) console() Console {
+	if vm.Console == nil {
+		vm.Console = NewConsole(vm.Stdin, vm.Stdout)
+	}
+	return vm.Console
+}
+
+// Flush writes out any output the console is holding.
+func (vm *VM) Flush() error {
+	if vm.Console == nil {
+		return nil
+	}
+	return vm.Console.Flush()
+}
+
+// readLine reads a line from the console, including the newline.
+func (vm *VM) readLine() (string, error) {
+	var line []byte
+	for {
+		c, err := vm.console().ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			return string(line), nil
+		}
+	}
+}
+
+type streamConsole struct {
+	in  *bufio.Reader
+	out *bufio.Writer
+}
+
+// NewConsole returns a Console reading from in and writing to out through
+// buffers. Output is flushed before any read that would block. A nil in reads
+// as empty and a nil out discards.
+func NewConsole(in io.Reader, out io.Writer) Console {
+	if in == nil {
+		in = strings.NewReader("")
+	}
+	if out == nil {
+		out = ioutil.Discard
+	}
+	r, ok := in.(*bufio.Reader)
+	if !ok {
+		r = bufio.NewReader(in)
+	}
+	return &streamConsole{in: r, out: bufio.NewWriter(out)}
+}
+
+// NewTerminal returns a Console on the process's standard input and output.
+func NewTerminal() Console {
+	return NewConsole(os.Stdin, os.Stdout)
+}
+
+func (c *streamConsole) ReadByte() (byte, error) {
+	if c.in.Buffered() == 0 {
+		if err := c.out.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return c.in.ReadByte()
+}
+
+func (c *streamConsole) Buffered() int {
+	return c.in.Buffered()
+}
+
+func (c *streamConsole) WriteByte(b byte) error {
+	return c.out.WriteByte(b)
+}
+
+func (c *streamConsole) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *streamConsole) Flush() error {
+	return c.out.Flush()
+}
+
+// BufferConsole reads from In and writes to Out. Input can be added to In
+// between runs; reading past its end returns io.EOF.
+type BufferConsole struct {
+	In  bytes.Buffer
+	Out bytes.Buffer
+}
+
+func (c *BufferConsole) ReadByte() (byte, error) {
+	return c.In.ReadByte()
+}
+
+func (c *BufferConsole) Buffered() int {
+	return c.In.Len()
+}
+
+func (c *BufferConsole) WriteByte(b byte) error {
+	return c.Out.WriteByte(b)
+}
+
+func (c *BufferConsole) Write(p []byte) (int, error) {
+	return c.Out.Write(p)
+}
+
+func (c *BufferConsole) Flush() error {
+	return nil
+}
+
+// ScriptConsole feeds Lines to the program one at a time, each followed by a
+// newline, and then returns io.EOF. Output goes to Out, which may be nil. With
+// Echo set each line is also written to Out as it is started, so Out reads
+// like a transcript.
+type ScriptConsole struct {
+	Lines []string
+	Out   io.Writer
+	Echo  bool
+	line  int
+	pos   int
+}
+
+func (c *ScriptConsole) ReadByte() (byte, error) {
+	if c.line >= len(c.Lines) {
+		return 0, io.EOF
+	}
+	l := c.Lines[c.line]
+	if c.pos == 0 && c.Echo {
+		c.Write([]byte(l + "\n"))
+	}
+	if c.pos == len(l) {
+		c.line++
+		c.pos = 0
+		return '\n', nil
+	}
+	c.pos++
+	return l[c.pos-1], nil
+}
+
+// Remaining returns the lines that have not been started.
+func (c *ScriptConsole) Remaining() []string {
+	if c.line >= len(c.Lines) {
+		return nil
+	}
+	if c.pos > 0 {
+		return c.Lines[c.line+1:]
+	}
+	return c.Lines[c.line:]
+}
+
+// Buffered returns what is left of the line being read, so that a prompt is
+// seen before each line.
+func (c *ScriptConsole) Buffered() int {
+	if c.pos == 0 || c.line >= len(c.Lines) {
+		return 0
+	}
+	return len(c.Lines[c.line]) + 1 - c.pos
+}
+
+func (c *ScriptConsole) WriteByte(b byte) error {
+	_, err := c.Write([]byte{b})
+	return err
+}
+
+func (c *ScriptConsole) Write(p []byte) (int, error) {
+	if c.Out == nil {
+		return len(p), nil
+	}
+	return c.Out.Write(p)
+}
+
+func (c *ScriptConsole) Flush() error {
+	return nil
+}
+
+type teeConsole struct {
+	Console
+	w io.Writer
+}
+
+// NewTeeConsole returns a Console that passes everything through to c and
+// also copies both the bytes read and the bytes written to w, such as a
+// transcript file.
+func NewTeeConsole(c Console, w io.Writer) Console {
+	return &teeConsole{c, w}
+}
+
+func (t *teeConsole) ReadByte() (byte, error) {
+	b, err := t.Console.ReadByte()
+	if err == nil {
+		t.w.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (t *teeConsole) WriteByte(b byte) error {
+	t.w.Write([]byte{b})
+	return t.Console.WriteByte(b)
+}
+
+func (t *teeConsole) Write(p []byte) (int, error) {
+	t.w.Write(p)
+	return t.Console.Write(p)
+}
+
+func (t *teeConsole) Buffered() int {
+	if b, ok := t.Console.(buffered); ok {
+		return b.Buffered()
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// echo copies its input to its output until input runs out.
+var echo = []uint16{
+	20, 32768, // in R0
+	19, 32768, // out R0
+	6, 0, // jmp 0
+}
+
+func newEcho(c Console) *VM {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize), Console: c}
+	copy(v.Mem, echo)
+	return v
+}
+
+func TestConsoles(t *testing.T) {
+	buf := &BufferConsole{}
+	buf.In.WriteString("look\n")
+	v := newEcho(buf)
+	if r := v.RunN(-1); r.Reason() != InputExhausted || buf.Out.String() != "look\n" {
+		t.Fatalf("buffer console stopped with %v, printed %q", r.Err, buf.Out.String())
+	}
+	buf.In.WriteString("inv\n")
+	if v.RunN(-1); buf.Out.String() != "look\ninv\n" {
+		t.Fatalf("resumed buffer console printed %q", buf.Out.String())
+	}
+
+	out := &bytes.Buffer{}
+	script := &ScriptConsole{Lines: []string{"north", "south"}, Out: out, Echo: true}
+	v = newEcho(script)
+	v.RunN(14)
+	if rest := script.Remaining(); len(rest) != 1 || rest[0] != "south" {
+		t.Errorf("remaining script %q", rest)
+	}
+	v.RunN(-1)
+	if want := "north\nnorth\nsouth\nsouth\n"; out.String() != want {
+		t.Errorf("script console printed %q, want %q", out, want)
+	}
+
+	transcript, stdout := &bytes.Buffer{}, &bytes.Buffer{}
+	v = newEcho(NewTeeConsole(NewConsole(strings.NewReader("ab"), stdout), transcript))
+	v.RunN(-1)
+	if stdout.String() != "ab" || transcript.String() != "aabb" {
+		t.Errorf("tee console printed %q, copied %q", stdout, transcript)
+	}
+}
+
+func TestStdinStdout(t *testing.T) {
+	out := &bytes.Buffer{}
+	v := newEcho(nil)
+	v.Stdin, v.Stdout = strings.NewReader("take tablet\n"), out
+	v.RunN(-1)
+	if out.String() != "take tablet\n" {
+		t.Errorf("printed %q", out)
+	}
+}
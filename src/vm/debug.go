@@ -1,10 +1,12 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 func (vm *VM) R() string {
@@ -20,21 +22,26 @@ func (vm *VM) R() string {
 }
 
 func (vm *VM) Debug() error {
+	atomic.StoreInt32(&vm.attached, 1)
+	defer atomic.StoreInt32(&vm.attached, 0)
 	var fields []string
 	var repeat int
 	var lastLine string
 	for {
 		state := <-vm.ControlChan
-		if state != "break" {
+		if !errors.Is(state, Breakpoint) {
 			close(vm.ControlChan)
-			return fmt.Errorf("%s", state)
+			return state
+		}
+		if !vm.Debugging && !vm.Step {
+			vm.Printf("debugger attached, c resumes the program and q quits\n")
 		}
 		dis := vm.Dis(vm.Ip, 1)
 		vm.Printf("%v\n%v\n", dis[0], vm.R())
 	replLoop:
 		for {
 			vm.Printf("DBG> ")
-			line, err := vm.Stdin.ReadString('\n')
+			line, err := vm.readLine()
 			if err != nil {
 				return err
 			}
@@ -52,6 +59,9 @@ func (vm *VM) Debug() error {
 			case "c":
 				vm.Step = false
 				break replLoop
+			case "q", "quit":
+				close(vm.ControlChan)
+				return nil
 			case "d":
 				p := vm.Ip
 				l := 32
@@ -106,7 +116,7 @@ func (vm *VM) Debug() error {
 					vm.Printf("break <addr>\n%v\n", err)
 					continue replLoop
 				}
-				vm.Break[uint16(l)] = true
+				vm.setBreak(uint16(l), true)
 			case "del":
 				if len(fields) != 2 {
 					vm.Printf("del <addr>\n")
@@ -117,7 +127,7 @@ func (vm *VM) Debug() error {
 					vm.Printf("del <addr>\n%v\n", err)
 					continue replLoop
 				}
-				vm.Break[uint16(l)] = false
+				vm.setBreak(uint16(l), false)
 			case "ann":
 				if len(fields) < 3 {
 					vm.Printf("ann <addr> <note>\n")
@@ -145,6 +155,97 @@ func (vm *VM) Debug() error {
 				if err != nil {
 					vm.Printf("%v\n", err)
 				}
+			case "mark":
+				vm.mark = vm.Snapshot("mark")
+				vm.Printf("marked at %v after %v instructions\n", vm.Ip, vm.Counter)
+			case "diff":
+				usage := "diff [data] [<save file>]\n"
+				args := fields[1:]
+				data := len(args) > 0 && args[0] == "data"
+				if data {
+					args = args[1:]
+				}
+				old := vm.mark
+				if len(args) == 1 {
+					s, err := ReadSaveFile(args[0])
+					if err != nil {
+						vm.Printf("%v\n", err)
+						continue replLoop
+					}
+					old = s
+				} else if len(args) > 1 || old == nil {
+					vm.Printf("%s", usage)
+					continue replLoop
+				}
+				d := Diff(&old.State, &vm.State)
+				if data {
+					d.Filter(vm.IsData)
+				}
+				vm.Printf("%v", d)
+			case "record":
+				usage := "record [<instructions>|off]\n"
+				n := 1000000
+				if len(fields) == 2 && fields[1] == "off" {
+					n = 0
+				} else if len(fields) == 2 {
+					var err error
+					if n, err = strconv.Atoi(fields[1]); err != nil || n < 0 {
+						vm.Printf("%s", usage)
+						continue replLoop
+					}
+				} else if len(fields) > 2 {
+					vm.Printf("%s", usage)
+					continue replLoop
+				}
+				vm.Journal = n
+				vm.ClearJournal()
+				vm.Printf("recording the last %v instructions\n", n)
+			case "rs", "reverse-step":
+				n := 1
+				if len(fields) == 2 {
+					var err error
+					if n, err = strconv.Atoi(fields[1]); err != nil {
+						vm.Printf("rs [<instructions>]\n")
+						continue replLoop
+					}
+				}
+				if undone := vm.ReverseStep(n); undone < n {
+					vm.Printf("start of journal after %v instructions\n", undone)
+				}
+				dis := vm.Dis(vm.Ip, 1)
+				vm.Printf("%v\n%v\n", dis[0], vm.R())
+			case "rc", "reverse-continue":
+				if !vm.ReverseContinue() {
+					vm.Printf("start of journal\n")
+				}
+				dis := vm.Dis(vm.Ip, 1)
+				vm.Printf("%v\n%v\n", dis[0], vm.R())
+			case "who":
+				usage := "who <addr>|R<n>\n"
+				if len(fields) != 2 {
+					vm.Printf("%s", usage)
+					continue replLoop
+				}
+				var addr int
+				var err error
+				if strings.HasPrefix(fields[1], "R") {
+					addr, err = strconv.Atoi(fields[1][1:])
+					if err != nil || addr < 0 || addr > 7 {
+						vm.Printf("%s", usage)
+						continue replLoop
+					}
+					addr += 32768
+				} else if addr, err = strconv.Atoi(fields[1]); err != nil || addr < 0 || addr >= len(vm.Mem) {
+					vm.Printf("%s", usage)
+					continue replLoop
+				}
+				w, ok := vm.LastWrite(uint16(addr))
+				if !ok {
+					vm.Printf("no write to %v in the last %v instructions\n", fields[1], vm.Journalled())
+					continue replLoop
+				}
+				dis := vm.Dis(w.Ip, 1)
+				vm.Printf("%v\nwrote %v over %v after %v instructions\n", dis[0], w.New, w.Old, w.Counter)
 			case "r":
 				if len(fields) != 3 {
 					vm.Printf("r <number> <value>\n")
@@ -161,25 +262,28 @@ func (vm *VM) Debug() error {
 					continue replLoop
 				}
 				vm.Registers[r] = uint16(v)
+				// The journal can't undo past an edit it didn't record.
+				vm.ClearJournal()
 				dis := vm.Dis(vm.Ip, 1)
 				vm.Printf("%v\n%v\n", dis[0], vm.R())
 			case "m":
 				usage := "m <address> <value>\n"
 				if len(fields) != 3 {
-					vm.Printf(usage)
+					vm.Printf("%s", usage)
 					continue replLoop
 				}
 				p, err := strconv.Atoi(fields[1])
-				if err != nil || p > len(vm.Mem) {
-					vm.Printf(usage)
+				if err != nil || p < 0 || p >= len(vm.Mem) {
+					vm.Printf("%s", usage)
 					continue replLoop
 				}
 				v, err := strconv.Atoi(fields[2])
 				if err != nil {
-					vm.Printf(usage)
+					vm.Printf("%s", usage)
 					continue replLoop
 				}
-				vm.Mem[p] = uint16(v)
+				vm.WriteMem(uint16(p), uint16(v))
+				vm.ClearJournal()
 			case "string":
 				if len(fields) != 2 {
 					vm.Printf("string <address>\n")
@@ -227,6 +331,20 @@ func (vm *VM) Debug() error {
 				vm.Printf("error, no such debugger command: %v\n", fields[0])
 			}
 		}
-		vm.ControlChan <- ""
+		vm.ControlChan <- nil
+	}
+}
+
+// setBreak sets or clears a breakpoint, recording it in the metadata so that
+// it is armed again whenever the metadata is loaded.
+func (vm *VM) setBreak(addr uint16, on bool) {
+	vm.Break[addr] = on
+	if vm.meta.Breakpoints == nil {
+		return
+	}
+	if on {
+		vm.meta.Breakpoints[addr] = true
+	} else {
+		delete(vm.meta.Breakpoints, addr)
 	}
 }
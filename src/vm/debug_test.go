@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachDebugger(t *testing.T) {
+	c := &BufferConsole{}
+	c.In.WriteString("a\n!dbg\nbt\nc\nb\n!dbg\nq\n")
+	v := newEcho(c)
+	v.Escape = "!"
+	v.ControlChan = make(chan error)
+	go v.Serve()
+	v.Start()
+	if err := v.Debug(); err != nil {
+		t.Fatalf("debugger returned %v", err)
+	}
+	out := c.Out.String()
+	if n := strings.Count(out, "debugger attached"); n != 2 || !strings.Contains(out, "a\n") || !strings.Contains(out, "b\n") {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestMetadataBreakpoints(t *testing.T) {
+	md := filepath.Join(t.TempDir(), "metadata")
+	v := newEcho(&BufferConsole{})
+	v.MetadataFile = md
+	v.LoadMetadata()
+	v.setBreak(2, true)
+	v.setBreak(4, true)
+	v.setBreak(4, false)
+	if err := v.SaveMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &BufferConsole{}
+	c.In.WriteString("ab")
+	v = newEcho(c)
+	v.MetadataFile = md
+	v.LoadMetadata()
+	for i := 0; i < 2; i++ {
+		if r := v.RunN(-1); r.Reason() != Breakpoint || v.Ip != 2 {
+			t.Fatalf("stopped with %v at %v", r.Err, v.Ip)
+		}
+	}
+	if c.Out.String() != "a" {
+		t.Errorf("printed %q at second breakpoint", c.Out.String())
+	}
+}
+
+func TestDebuggerEditClearsJournal(t *testing.T) {
+	c := &BufferConsole{}
+	c.In.WriteString("a\n!dbg\nr 0 9\nrs\nwho R0\nq\n")
+	v := newEcho(c)
+	v.Escape = "!"
+	v.Journal = 10
+	v.ControlChan = make(chan error)
+	go v.Serve()
+	v.Start()
+	if err := v.Debug(); err != nil {
+		t.Fatalf("debugger returned %v", err)
+	}
+	out := c.Out.String()
+	if !strings.Contains(out, "start of journal after 0 instructions") || !strings.Contains(out, "no write to R0") || v.Registers[0] != 9 {
+		t.Errorf("R0 %v, printed %q", v.Registers[0], out)
+	}
+}
+
+func TestDisEndOfMemory(t *testing.T) {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize)}
+	if dis := v.Dis(MemSize-8, 32); len(dis) != 8 {
+		t.Errorf("disassembled %v lines from the last 8 words", len(dis))
+	}
+}
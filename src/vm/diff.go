@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MemChange is a word of Mem that differs between two states.
+type MemChange struct {
+	Addr uint16
+	Old  uint16
+	New  uint16
+}
+
+// StateDiff is the difference between two states. Kept is the depth of the
+// bottom of the stack the two have in common, above which Popped was only in
+// the old state and Pushed is only in the new one.
+type StateDiff struct {
+	OldIp, NewIp uint16
+	OldRegs      []uint16
+	NewRegs      []uint16
+	Kept         int
+	Popped       []uint16
+	Pushed       []uint16
+	Mem          []MemChange
+}
+
+// Diff compares two states.
+func Diff(old, new *State) *StateDiff {
+	d := &StateDiff{
+		OldIp:   old.Ip,
+		NewIp:   new.Ip,
+		OldRegs: old.Registers,
+		NewRegs: new.Registers,
+	}
+	for d.Kept < len(old.Stack) && d.Kept < len(new.Stack) && old.Stack[d.Kept] == new.Stack[d.Kept] {
+		d.Kept++
+	}
+	d.Popped = old.Stack[d.Kept:]
+	d.Pushed = new.Stack[d.Kept:]
+	for i := 0; i < len(old.Mem) || i < len(new.Mem); i++ {
+		if o, n := word(old.Mem, i), word(new.Mem, i); o != n {
+			d.Mem = append(d.Mem, MemChange{uint16(i), o, n})
+		}
+	}
+	return d
+}
+
+// Filter drops the memory changes at addresses keep rejects.
+func (d *StateDiff) Filter(keep func(addr uint16) bool) *StateDiff {
+	var mem []MemChange
+	for _, c := range d.Mem {
+		if keep(c.Addr) {
+			mem = append(mem, c)
+		}
+	}
+	d.Mem = mem
+	return d
+}
+
+// Empty reports whether the states are the same.
+func (d *StateDiff) Empty() bool {
+	return d.OldIp == d.NewIp && len(d.ChangedRegisters()) == 0 && len(d.Popped) == 0 && len(d.Pushed) == 0 && len(d.Mem) == 0
+}
+
+// ChangedRegisters returns the numbers of the registers that differ.
+func (d *StateDiff) ChangedRegisters() []int {
+	var r []int
+	for i := 0; i < len(d.OldRegs) || i < len(d.NewRegs); i++ {
+		if word(d.OldRegs, i) != word(d.NewRegs, i) {
+			r = append(r, i)
+		}
+	}
+	return r
+}
+
+func word(s []uint16, i int) uint16 {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+func (d *StateDiff) String() string {
+	var b bytes.Buffer
+	if d.OldIp != d.NewIp {
+		fmt.Fprintf(&b, "ip: %v -> %v\n", d.OldIp, d.NewIp)
+	}
+	for _, r := range d.ChangedRegisters() {
+		fmt.Fprintf(&b, "R%v: %v -> %v\n", r, word(d.OldRegs, r), word(d.NewRegs, r))
+	}
+	if len(d.Popped) > 0 || len(d.Pushed) > 0 {
+		fmt.Fprintf(&b, "stack above %v: %v -> %v\n", d.Kept, d.Popped, d.Pushed)
+	}
+	for _, c := range d.Mem {
+		fmt.Fprintf(&b, "mem %v: %v -> %v%v\n", c.Addr, c.Old, c.New, chars(c.Old, c.New))
+	}
+	return b.String()
+}
+
+// chars shows a changed word as characters when both are printable.
+func chars(old, new uint16) string {
+	if old >= 32 && old < 127 && new >= 32 && new < 127 {
+		return fmt.Sprintf(" '%c' -> '%c'", old, new)
+	}
+	return ""
+}
+
+// IsData reports whether the metadata shows addr being written but never
+// executed, so that it holds game state rather than code. It is true of
+// every address when no metadata has been loaded.
+func (vm *VM) IsData(addr uint16) bool {
+	if vm.meta.WriteMem == nil || int(addr) >= len(vm.meta.WriteMem) {
+		return true
+	}
+	return vm.meta.WriteMem[addr] && !vm.meta.ExecMem[addr]
+}
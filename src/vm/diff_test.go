@@ -0,0 +1,38 @@
+package vm
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &State{
+		Mem:       []uint16{1, 2, 3, 65},
+		Registers: []uint16{0, 5, 0, 0, 0, 0, 0, 0},
+		Stack:     []uint16{10, 11, 12},
+		Ip:        4,
+	}
+	new := &State{
+		Mem:       []uint16{1, 9, 3, 66, 7},
+		Registers: []uint16{0, 6, 0, 0, 0, 0, 0, 1},
+		Stack:     []uint16{10, 13},
+		Ip:        4,
+	}
+	d := Diff(old, new)
+	want := `R1: 5 -> 6
+R7: 0 -> 1
+stack above 1: [11 12] -> [13]
+mem 1: 2 -> 9
+mem 3: 65 -> 66 'A' -> 'B'
+mem 4: 0 -> 7
+`
+	if d.String() != want {
+		t.Errorf("diff\n%v\nwant\n%v", d, want)
+	}
+	d.Filter(func(addr uint16) bool { return addr != 3 })
+	if len(d.Mem) != 2 || d.Mem[1].Addr != 4 {
+		t.Errorf("filtered memory changes %v", d.Mem)
+	}
+	if d.Empty() || !Diff(old, old).Empty() {
+		t.Errorf("Empty wrong")
+	}
+}
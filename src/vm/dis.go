@@ -3,12 +3,13 @@ package vm
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 func (vm *VM) Dis(p uint16, n int) []string {
 	var dis []string
 	start := p
-	for p < start+uint16(n) {
+	for p < start+uint16(n) && int(p) < len(vm.Mem) {
 		s := fmt.Sprintf("%8d ", p)
 		str := vm.String(p)
 		if str == "" && vm.Mem[p] < uint16(len(vm.Mem)) && vm.Mem[p] > uint16(512) {
@@ -55,8 +56,12 @@ func (vm *VM) Dis(p uint16, n int) []string {
 }
 
 func (vm *VM) String(p uint16) string {
+	size := len(vm.Mem)
+	if int(p) >= size {
+		return ""
+	}
 	len := vm.Mem[p]
-	if len > 1024 || len == 0 {
+	if len > 1024 || len == 0 || int(p)+int(len) >= size {
 		return ""
 	}
 	var b [1024]byte
@@ -69,3 +74,9 @@ func (vm *VM) String(p uint16) string {
 	}
 	return fmt.Sprintf("%v:%v:\"%v\"", p, len, string(b[:len]))
 }
+
+// Disassemble returns the listing of Mem from 0 up to end, one line per
+// instruction.
+func (vm *VM) Disassemble(end uint16) string {
+	return strings.Join(vm.Dis(0, int(end)), "\n") + "\n"
+}
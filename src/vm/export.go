@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// An exported image is the state's memory with Mem[0..1] replaced by a jmp to
+// a prologue written into a run of zero words. The prologue pushes the stack,
+// puts back Mem[0..1] from two data cells in front of it, sets the registers,
+// zeroes the data cells and itself up to its last exportTail words, and jumps
+// to Ip:
+//
+//	cells:  <Mem[0]> <Mem[1]>
+//	start:  push <s> ...
+//	        rmem R0 cells; wmem 0 R0; rmem R0 cells+1; wmem 1 R0
+//	        set R2 <r2> ... set R7 <r7>
+//	        set R0 cells
+//	loop:   wmem R0 0; add R0 R0 1; eq R1 R0 loop; jf R1 loop
+//	        set R0 <r0>; set R1 <r1>; jmp <ip>
+const exportTail = 22
+
+// PrologueSize returns the number of words the prologue for st needs.
+func PrologueSize(st *State) int {
+	return 2 + 2*len(st.Stack) + 12 + 3*6 + 3 + exportTail
+}
+
+// PrologueAddr returns the highest address at which the prologue for st fits
+// in words that are zero in its memory, or -1 if there is no room.
+func PrologueAddr(st *State) int {
+	size := PrologueSize(st)
+	run := 0
+	for a := MemSize - 1; a >= 2; a-- {
+		if a < len(st.Mem) && st.Mem[a] != 0 {
+			run = 0
+			continue
+		}
+		if run++; run == size {
+			return a
+		}
+	}
+	return -1
+}
+
+// Image returns st as a program image for any Synacor machine, with its
+// prologue at address at. Running the image leaves the machine in st, except
+// for the last exportTail words of the prologue.
+func Image(st *State, at int) ([]uint16, error) {
+	size := PrologueSize(st)
+	if at < 2 || at+size > MemSize {
+		return nil, fmt.Errorf("no room for a %v word prologue at %v", size, at)
+	}
+	for a := at; a < at+size && a < len(st.Mem); a++ {
+		if st.Mem[a] != 0 {
+			return nil, fmt.Errorf("prologue at %v would overwrite Mem[%v]", at, a)
+		}
+	}
+	if len(st.Registers) != 8 {
+		return nil, fmt.Errorf("state has %v registers", len(st.Registers))
+	}
+	for r, v := range st.Registers {
+		if v > 32767 {
+			return nil, fmt.Errorf("R%v value %v cannot be set", r, v)
+		}
+	}
+	image := make([]uint16, MemSize)
+	copy(image, st.Mem)
+	const r0, r1 = 32768, 32769
+	cells := uint16(at)
+	p := []uint16{image[0], image[1]}
+	start := uint16(at + len(p))
+	for _, s := range st.Stack {
+		if s > 32767 {
+			return nil, fmt.Errorf("stack value %v cannot be pushed", s)
+		}
+		p = append(p, 2, s)
+	}
+	p = append(p, 15, r0, cells, 16, 0, r0, 15, r0, cells+1, 16, 1, r0)
+	for r := 2; r < 8; r++ {
+		p = append(p, 1, uint16(32768+r), st.Registers[r])
+	}
+	p = append(p, 1, r0, cells)
+	loop := uint16(at + len(p))
+	p = append(p, 16, r0, 0, 9, r0, r0, 1, 4, r1, r0, loop, 8, r1, loop)
+	p = append(p, 1, r0, st.Registers[0], 1, r1, st.Registers[1], 6, st.Ip)
+	copy(image[at:], p)
+	image[0], image[1] = 6, start
+	end := len(image)
+	for end > 0 && image[end-1] == 0 {
+		end--
+	}
+	return image[:end], nil
+}
+
+// WriteImage writes st as a program image with its prologue at the highest
+// place it fits.
+func WriteImage(w io.Writer, st *State) error {
+	at := PrologueAddr(st)
+	if at < 0 {
+		return fmt.Errorf("no room for a %v word prologue", PrologueSize(st))
+	}
+	image, err := Image(st, at)
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, image)
+}
@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestExportImage(t *testing.T) {
+	v := &VM{Console: &BufferConsole{}}
+	if err := v.LoadVM("../../the-beach-2016-01-14T13:14:14-05:00"); err != nil {
+		t.Skip(err)
+	}
+	st := v.State
+	var buf bytes.Buffer
+	if err := WriteImage(&buf, &st); err != nil {
+		t.Fatal(err)
+	}
+	image := make([]uint16, buf.Len()/2)
+	binary.Read(&buf, binary.LittleEndian, image)
+
+	// Run the prologue up to the saved Ip and compare.
+	c := &BufferConsole{}
+	e := &VM{State: State{Mem: make([]uint16, MemSize), Registers: make([]uint16, 8)}, Console: c}
+	copy(e.Mem, image)
+	e.Break = map[uint16]bool{st.Ip: true}
+	if r := e.RunN(100000); r.Reason() != Breakpoint || e.Ip != st.Ip {
+		t.Fatalf("prologue stopped with %v at %v", r.Err, e.Ip)
+	}
+	if fmt.Sprint(e.Registers, e.Stack) != fmt.Sprint(st.Registers, st.Stack) {
+		t.Errorf("prologue restored %v %v, want %v %v", e.Registers, e.Stack, st.Registers, st.Stack)
+	}
+	at := PrologueAddr(&st)
+	tail := at + PrologueSize(&st) - exportTail
+	for a := range e.Mem {
+		if e.Mem[a] != st.Mem[a] && (a < tail || a >= tail+exportTail) {
+			t.Errorf("Mem[%v] = %v, want %v", a, e.Mem[a], st.Mem[a])
+		}
+	}
+
+	// Then play on from both.
+	e.Break = nil
+	c.In.WriteString("look\ninv\n")
+	e.RunN(-1)
+	v.Console.(*BufferConsole).In.WriteString("look\ninv\n")
+	v.RunN(-1)
+	if got, want := c.Out.String(), v.Console.(*BufferConsole).Out.String(); got != want {
+		t.Errorf("exported image printed\n%v\nsave printed\n%v", got, want)
+	}
+}
+
+func TestImageRejectsBadValues(t *testing.T) {
+	for _, st := range []State{
+		{Registers: make([]uint16, 8), Stack: []uint16{32768}},
+		{Registers: []uint16{0, 0, 0, 32768, 0, 0, 0, 0}},
+	} {
+		if _, err := Image(&st, PrologueAddr(&st)); err == nil {
+			t.Errorf("exported registers %v and stack %v", st.Registers, st.Stack)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden transcripts in testdata")
+
+// goldenCases run an image with the input lines in testdata/<name>.in and
+// compare the transcript against testdata/<name>.golden.
+var goldenCases = []struct {
+	name  string
+	image string
+	save  bool
+}{
+	{"walkthrough", "../../challenge.bin", false},
+	{"the-beach", "../../the-beach-2016-01-14T13:14:14-05:00", true},
+	{"unlocked", "../../unlocked-2015-12-03T11:17:45-05:00", true},
+}
+
+func readLines(t *testing.T, name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// transcript runs the image with the input echoed into the output, ending
+// with how and where the machine stopped.
+func transcript(t *testing.T, image string, save, jit bool, input []string) string {
+	out := &bytes.Buffer{}
+	v := &VM{JIT: jit, Console: &ScriptConsole{Lines: input, Out: out, Echo: true}}
+	var err error
+	if save {
+		err = v.LoadVM(image)
+	} else {
+		err = v.Load(image)
+	}
+	if err != nil {
+		t.Skip(err)
+	}
+	out.Reset()
+	r := v.RunN(100000000)
+	fmt.Fprintf(out, "\n-- stopped: %v after %v instructions\n", r.Err, r.Executed)
+	return out.String()
+}
+
+func TestGoldenTranscripts(t *testing.T) {
+	for _, c := range goldenCases {
+		input := readLines(t, "testdata/"+c.name+".in")
+		golden := "testdata/" + c.name + ".golden"
+		got := transcript(t, c.image, c.save, false, input)
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%v (run with -update to create it)", err)
+		}
+		if got != string(want) {
+			t.Errorf("%v: transcript differs from %v at line %v", c.name, golden, firstDiff(got, string(want)))
+		}
+		if jit := transcript(t, c.image, c.save, true, input); jit != got {
+			t.Errorf("%v: JIT transcript differs from the interpreter's at line %v", c.name, firstDiff(jit, got))
+		}
+	}
+}
+
+// firstDiff returns the first line, counting from 1, at which a and b differ.
+func firstDiff(a, b string) int {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := range al {
+		if i >= len(bl) || al[i] != bl[i] {
+			return i + 1
+		}
+	}
+	return len(al) + 1
+}
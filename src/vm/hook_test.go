@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"testing"
+)
+
+// check6027 is the confirmation routine at 6027 written in Go.
+func check6027(r0, r1, r7 uint16, cache map[uint32]uint32) (uint16, uint16) {
+	key := uint32(r0)<<16 | uint32(r1)
+	if v, ok := cache[key]; ok {
+		return uint16(v >> 16), uint16(v)
+	}
+	a, b := r0, r1
+	switch {
+	case r0 == 0:
+		a = mod(r1 + 1)
+	case r1 == 0:
+		a, b = check6027(mod(r0+32767), r7, r7, cache)
+	default:
+		b, _ = check6027(r0, mod(r1+32767), r7, cache)
+		a, b = check6027(mod(r0+32767), b, r7, cache)
+	}
+	cache[key] = uint32(a)<<16 | uint32(b)
+	return a, b
+}
+
+func call6027(t *testing.T, hook HookFunc, r0, r1, r7 uint16) *VM {
+	v := &VM{}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	v.Hook(6027, hook)
+	v.Mem[32000] = 17 // call 6027
+	v.Mem[32001] = 6027
+	v.Mem[32002] = 0 // halt
+	v.Ip = 32000
+	v.Registers[0], v.Registers[1], v.Registers[7] = r0, r1, r7
+	if err := v.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestHook(t *testing.T) {
+	want := call6027(t, nil, 3, 1, 2)
+	got := call6027(t, func(vm *VM) error {
+		r := vm.Registers
+		r[0], r[1] = check6027(r[0], r[1], r[7], map[uint32]uint32{})
+		return nil
+	}, 3, 1, 2)
+	if got.Registers[0] != want.Registers[0] || got.Registers[1] != want.Registers[1] {
+		t.Errorf("hooked 6027 returned %v, interpreted %v", got.Registers[:2], want.Registers[:2])
+	}
+	if got.Ip != want.Ip || len(got.Stack) != 0 {
+		t.Errorf("hooked call returned to %v with stack %v, want %v", got.Ip, got.Stack, want.Ip)
+	}
+	if got.Counter >= want.Counter {
+		t.Errorf("hooked call executed %v instructions, interpreted %v", got.Counter, want.Counter)
+	}
+}
+
+func TestHookPatchesCode(t *testing.T) {
+	for _, jit := range []bool{false, true} {
+		c := &BufferConsole{}
+		v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize), Console: c, JIT: jit}
+		copy(v.Mem, []uint16{
+			19, 'a', // out 'a'
+			17, 20, // call 20
+			4, 32769, 32768, 5, // eq R1 R0 5
+			8, 32769, 0, // jf R1 0
+			0, // halt
+		})
+		// The hook turns the out into two noops.
+		v.Hook(20, func(vm *VM) error {
+			vm.WriteMem(0, 21)
+			vm.WriteMem(1, 21)
+			vm.Registers[0]++
+			return nil
+		})
+		if err := v.Run(); err != nil || c.Out.String() != "a" {
+			t.Errorf("jit %v: printed %q, stopped with %v", jit, c.Out.String(), err)
+		}
+	}
+}
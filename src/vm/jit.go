@@ -0,0 +1,264 @@
+package vm
+
+// The JIT compiles basic blocks of Mem into slices of closures whose operands
+// are already bound, and runs them in place of the interpreter once an address
+// has been reached jitThreshold times. A write into compiled code flushes every
+// block and leaves the written address to the interpreter from then on.
+//
+// Blocks mark ExecMem when they are compiled rather than as they run.
+
+const (
+	jitThreshold = 2
+	jitMaxBlock  = 64
+)
+
+type jitOp struct {
+	ip    uint16
+	next  uint16
+	codes []uint16
+	run   func(vm *VM) error
+}
+
+type block struct {
+	start uint16
+	end   int
+	ops   []jitOp
+}
+
+// block returns the compiled block starting at ip, compiling it if ip has
+// become hot, or nil if ip should be interpreted.
+func (vm *VM) block(ip uint16) *block {
+	vm.OwnMem()
+	if vm.blocks == nil {
+		vm.blocks = make([]*block, len(vm.Mem))
+		vm.heat = make([]uint8, len(vm.Mem))
+		vm.covered = make([]bool, len(vm.Mem))
+	}
+	if vm.dirty == nil {
+		vm.dirty = make([]bool, len(vm.Mem))
+	}
+	if int(ip) >= len(vm.blocks) {
+		return nil
+	}
+	if b := vm.blocks[ip]; b != nil {
+		return b
+	}
+	if vm.heat[ip] < jitThreshold {
+		vm.heat[ip]++
+		return nil
+	}
+	vm.heat[ip] = 0
+	b := vm.compile(ip)
+	vm.blocks[ip] = b
+	return b
+}
+
+// flushBlocks drops every compiled block after addr, which lies in compiled
+// code, has been written.
+func (vm *VM) flushBlocks(addr uint16) {
+	vm.dirty[addr] = true
+	vm.flushCompiled()
+}
+
+func (vm *VM) compile(start uint16) *block {
+	b := &block{start: start}
+	ip := int(start)
+compiling:
+	for len(b.ops) < jitMaxBlock && ip < len(vm.Mem) {
+		in := &vm.code[ip]
+		if in.size == 0 && vm.decode(uint16(ip)) != nil {
+			break
+		}
+		next := ip + int(in.size)
+		for a := ip; a < next && a < len(vm.dirty); a++ {
+			if vm.dirty[a] {
+				break compiling
+			}
+		}
+		b.ops = append(b.ops, jitOp{
+			ip:    uint16(ip),
+			next:  uint16(next),
+			codes: in.codes(),
+			run:   vm.compileOp(uint16(ip), in),
+		})
+		ip = next
+		switch Ops[in.op].Name {
+		case "Halt", "Jmp", "JT", "JF", "Call", "Ret", "In":
+			break compiling
+		}
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	b.end = ip
+	for a := int(start); a < b.end; a++ {
+		vm.covered[a] = true
+	}
+	if vm.meta.ExecMem != nil {
+		for _, op := range b.ops {
+			vm.meta.ExecMem[op.ip] = true
+		}
+	}
+	return b
+}
+
+// compileOp returns a closure executing the decoded instruction at ip.
+// Instructions without side effects beyond their operands and the stack get
+// specialised closures; the rest call through the Ops table.
+func (vm *VM) compileOp(ip uint16, in *instr) func(*VM) error {
+	a := make([]*uint16, in.size-1)
+	vm.bind(ip, in, a)
+	run := compileArgs(Ops[in.op], a)
+	if !in.writesMem {
+		return run
+	}
+	dest := in.dest
+	return func(vm *VM) error {
+		err := run(vm)
+		vm.invalidate(dest)
+		return err
+	}
+}
+
+func compileArgs(op Op, a []*uint16) func(*VM) error {
+	switch op.Name {
+	case "Set":
+		d, x := a[0], a[1]
+		return func(vm *VM) error {
+			*d = *x
+			return nil
+		}
+	case "Push":
+		x := a[0]
+		return func(vm *VM) error {
+			vm.Stack = append(vm.Stack, *x)
+			return nil
+		}
+	case "Pop":
+		d := a[0]
+		return func(vm *VM) error {
+			if len(vm.Stack) == 0 {
+				return StackUnderflow
+			}
+			*d = vm.Stack[len(vm.Stack)-1]
+			vm.Stack = vm.Stack[:len(vm.Stack)-1]
+			return nil
+		}
+	case "Eq":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			if *x == *y {
+				*d = 1
+			} else {
+				*d = 0
+			}
+			return nil
+		}
+	case "Gt":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			if *x > *y {
+				*d = 1
+			} else {
+				*d = 0
+			}
+			return nil
+		}
+	case "Jmp":
+		x := a[0]
+		return func(vm *VM) error {
+			vm.Ip = *x
+			return nil
+		}
+	case "JT":
+		x, y := a[0], a[1]
+		return func(vm *VM) error {
+			if *x != 0 {
+				vm.Ip = *y
+			}
+			return nil
+		}
+	case "JF":
+		x, y := a[0], a[1]
+		return func(vm *VM) error {
+			if *x == 0 {
+				vm.Ip = *y
+			}
+			return nil
+		}
+	case "Add":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			*d = mod(*x + *y)
+			return nil
+		}
+	case "Mult":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			*d = mod(*x * *y)
+			return nil
+		}
+	case "Mod":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			if *y == 0 {
+				return DivideByZero
+			}
+			*d = mod(*x % *y)
+			return nil
+		}
+	case "And":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			*d = (*x & *y) & 0x7FFF
+			return nil
+		}
+	case "Or":
+		d, x, y := a[0], a[1], a[2]
+		return func(vm *VM) error {
+			*d = (*x | *y) & 0x7FFF
+			return nil
+		}
+	case "Not":
+		d, x := a[0], a[1]
+		return func(vm *VM) error {
+			*d = (^*x) & 0x7FFF
+			return nil
+		}
+	case "RMem":
+		d, x := a[0], a[1]
+		return func(vm *VM) error {
+			if int(*x) >= len(vm.Mem) {
+				return BadAddress
+			}
+			*d = vm.Mem[*x]
+			return nil
+		}
+	case "Noop":
+		return func(vm *VM) error {
+			return nil
+		}
+	}
+	f := op.Function
+	return func(vm *VM) error {
+		return f(vm, a)
+	}
+}
+
+// runBlock executes a compiled block, returning early if it writes into
+// compiled code.
+func (vm *VM) runBlock(b *block) error {
+	vm.smc = false
+	for i := range b.ops {
+		op := &b.ops[i]
+		vm.Ip = op.next
+		if err := op.run(vm); err != nil {
+			return vm.stopped(op.ip, op.codes, err)
+		}
+		vm.Counter++
+		if vm.smc {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jitScript = "take tablet\nuse tablet\ndoorway\nnorth\nnorth\nbridge\ncontinue\ndown\neast\ntake empty lantern\nwest\nwest\npassage\nladder\nwest\nsouth\nnorth\ntake can\nuse can\nuse lantern\nlook\ninv\n"
+
+func runEngines(t *testing.T, mem []uint16, input string, chunk int) {
+	var states [2]State
+	var counters [2]int
+	var outputs [2]string
+	for i, jit := range []bool{false, true} {
+		out := &bytes.Buffer{}
+		v := &VM{
+			Stdout: out,
+			Stdin:  bufio.NewReader(strings.NewReader(input)),
+			JIT:    jit,
+		}
+		if mem == nil {
+			if err := v.Load("../../challenge.bin"); err != nil {
+				t.Skip(err)
+			}
+		} else {
+			v.Registers = make([]uint16, 8)
+			v.Mem = make([]uint16, MemSize)
+			copy(v.Mem, mem)
+		}
+		for {
+			r := v.RunN(chunk)
+			if r.Err != nil {
+				break
+			}
+		}
+		states[i], counters[i], outputs[i] = v.State, v.Counter, out.String()
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("output differs:\ninterpreter:\n%v\njit:\n%v", outputs[0], outputs[1])
+	}
+	if counters[0] != counters[1] {
+		t.Errorf("instruction count differs: interpreter %v, jit %v", counters[0], counters[1])
+	}
+	if !reflect.DeepEqual(states[0], states[1]) {
+		t.Errorf("state differs: interpreter ip %v %v, jit ip %v %v",
+			states[0].Ip, states[0].Registers, states[1].Ip, states[1].Registers)
+	}
+}
+
+func TestJITMatchesInterpreter(t *testing.T) {
+	runEngines(t, nil, jitScript, -1)
+}
+
+func TestJITMatchesInterpreterInSlices(t *testing.T) {
+	runEngines(t, nil, jitScript, 997)
+}
+
+func TestJITSelfModifyingCode(t *testing.T) {
+	// A loop that rewrites the literal operand of its own add each pass.
+	runEngines(t, []uint16{
+		1, 32768, 20, // 0: set R0 20
+		9, 32769, 32769, 1, // 3: add R1 R1 1
+		16, 6, 32768, // 7: wmem 6 R0
+		9, 32768, 32768, 32767, // 10: add R0 R0 -1
+		7, 32768, 3, // 14: jt R0 3
+		0, // 17: halt
+	}, "", -1)
+}
@@ -0,0 +1,197 @@
+package vm
+
+// With Journal set, every instruction the interpreter executes is recorded
+// with what it overwrote, so that it can be undone. An instruction writes at
+// most one register or Mem word and moves the stacks by at most one entry;
+// a Call to a hook, which may change anything, is recorded as a clone. The JIT
+// is not used while journalling, as compiled blocks write through their own
+// pointers.
+
+// Write is a journalled instruction that wrote a register or Mem word.
+type Write struct {
+	Ip      uint16
+	Counter int
+	Addr    uint16 // a Mem address, or 32768+n for register n
+	Old     uint16
+	New     uint16
+}
+
+type journalEntry struct {
+	ip      uint16
+	counter int
+	wrote   bool
+	addr    uint16
+	old     uint16
+	new     uint16
+	stack   int
+	top     uint16
+	calls   int
+	callTop [2]uint16
+	in      bool
+	midLine bool
+	state   *VM
+}
+
+// journal is a ring of the most recent entries.
+type journal struct {
+	entries []journalEntry
+	start   int
+	n       int
+}
+
+func (j *journal) push(e journalEntry, max int) {
+	if j.n < len(j.entries) {
+		j.entries[(j.start+j.n)%len(j.entries)] = e
+		j.n++
+	} else if len(j.entries) < max {
+		j.entries = append(j.entries, e)
+		j.n++
+	} else {
+		j.entries[j.start] = e
+		j.start = (j.start + 1) % len(j.entries)
+	}
+}
+
+func (j *journal) pop() (journalEntry, bool) {
+	if j.n == 0 {
+		return journalEntry{}, false
+	}
+	j.n--
+	return j.entries[(j.start+j.n)%len(j.entries)], true
+}
+
+// at returns the ith entry counting back from the most recent.
+func (j *journal) at(i int) *journalEntry {
+	return &j.entries[(j.start+j.n-1-i)%len(j.entries)]
+}
+
+// Journalled returns the number of instructions that can be undone.
+func (vm *VM) Journalled() int {
+	return vm.history.n
+}
+
+// ClearJournal forgets every journalled instruction.
+func (vm *VM) ClearJournal() {
+	vm.history = journal{}
+}
+
+// record returns the journal entry for the instruction at ip before it runs.
+func (vm *VM) record(ip uint16, in *instr, args []*uint16) journalEntry {
+	e := journalEntry{ip: ip, counter: vm.Counter, stack: len(vm.Stack), calls: len(vm.CallStack)}
+	if e.stack > 0 {
+		e.top = vm.Stack[e.stack-1]
+	}
+	if e.calls > 1 {
+		copy(e.callTop[:], vm.CallStack[e.calls-2:])
+	}
+	op := Ops[in.op]
+	switch {
+	case op.Name == "WMem":
+		if int(*args[0]) < len(vm.Mem) {
+			e.wrote, e.addr = true, *args[0]
+		}
+	case op.Name == "Call":
+		if vm.hooks[*args[0]] != nil {
+			e.state = vm.Clone()
+		}
+	case op.Name == "In":
+		e.in, e.midLine = true, vm.midLine
+		fallthrough
+	case len(op.Args) > 0 && op.Args[0] == 'L':
+		e.wrote, e.addr = true, in.words[0]
+		if e.addr <= 32767 && op.Args[0] != 'L' {
+			e.addr = ip + 1
+		}
+	}
+	if e.wrote {
+		e.old = vm.location(e.addr)
+	}
+	return e
+}
+
+// remember adds the entry for an instruction that has run.
+func (vm *VM) remember(e journalEntry) {
+	if e.wrote {
+		e.new = vm.location(e.addr)
+	}
+	vm.history.push(e, vm.Journal)
+}
+
+func (vm *VM) location(addr uint16) uint16 {
+	if addr > 32767 {
+		return vm.Registers[addr-32768]
+	}
+	return vm.Mem[addr]
+}
+
+// ReverseStep undoes up to n journalled instructions and returns how many it
+// undid. Output is not taken back, while input is read again.
+func (vm *VM) ReverseStep(n int) int {
+	for i := 0; i < n; i++ {
+		e, ok := vm.history.pop()
+		if !ok {
+			return i
+		}
+		vm.undo(&e)
+	}
+	return n
+}
+
+// ReverseContinue undoes journalled instructions until Ip is at a
+// breakpoint, and reports whether it reached one before the journal ran out.
+func (vm *VM) ReverseContinue() bool {
+	for vm.ReverseStep(1) == 1 {
+		if vm.breakpoint() {
+			return true
+		}
+	}
+	return false
+}
+
+// LastWrite returns the most recent journalled write to addr, a Mem address
+// or 32768+n for register n.
+func (vm *VM) LastWrite(addr uint16) (Write, bool) {
+	for i := 0; i < vm.history.n; i++ {
+		e := vm.history.at(i)
+		if e.wrote && e.addr == addr {
+			return Write{Ip: e.ip, Counter: e.counter, Addr: e.addr, Old: e.old, New: e.new}, true
+		}
+	}
+	return Write{}, false
+}
+
+func (vm *VM) undo(e *journalEntry) {
+	if e.state != nil {
+		vm.setState(e.state)
+		vm.Counter = e.counter
+		return
+	}
+	if e.wrote && e.addr > 32767 {
+		vm.Registers[e.addr-32768] = e.old
+	} else if e.wrote {
+		vm.OwnMem()
+		vm.Mem[e.addr] = e.old
+		vm.invalidate(e.addr)
+	}
+	if len(vm.Stack) > e.stack {
+		vm.Stack = vm.Stack[:e.stack]
+	} else if len(vm.Stack) < e.stack {
+		vm.Stack = append(vm.Stack, e.top)
+	}
+	if len(vm.CallStack) > e.calls {
+		vm.CallStack = vm.CallStack[:e.calls]
+	} else if len(vm.CallStack) < e.calls {
+		vm.CallStack = append(vm.CallStack, e.callTop[:]...)
+	}
+	if e.in {
+		vm.pending = append([]byte{byte(e.new)}, vm.pending...)
+		vm.midLine = e.midLine
+		vm.prompted = true
+		vm.checkpointed = true
+		if len(vm.input) > 0 {
+			vm.input = vm.input[:len(vm.input)-1]
+		}
+	}
+	vm.Ip = e.ip
+	vm.Counter = e.counter
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReverseGame(t *testing.T) {
+	c := &BufferConsole{}
+	v := &VM{Console: c}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	if r := v.RunN(-1); r.Reason() != InputExhausted {
+		t.Fatalf("stopped with %v", r.Err)
+	}
+	start := v.Counter
+	v.Journal = 1 << 20
+	c.In.WriteString("take tablet\nlook\n")
+	type point struct {
+		counter int
+		hash    string
+	}
+	var points []point
+	for {
+		points = append(points, point{v.Counter, StateHash(&v.State)})
+		if r := v.RunN(97); r.Err != nil {
+			break
+		}
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+		v.ReverseStep(v.Counter - p.counter)
+		if h := StateHash(&v.State); v.Counter != p.counter || h != p.hash {
+			t.Fatalf("reversed to %v instructions with state %v, want %v with %v", v.Counter, h[:8], p.counter, p.hash[:8])
+		}
+	}
+	if v.Counter != start || v.Journalled() != 0 {
+		t.Fatalf("reversed to %v instructions with %v journalled, want %v", v.Counter, v.Journalled(), start)
+	}
+
+	// The input is read again.
+	c.Out.Reset()
+	v.RunN(-1)
+	if out := c.Out.String(); !strings.Contains(out, "Taken.") || !strings.Contains(out, "== Foothills ==") {
+		t.Errorf("run after reversing printed %q", out)
+	}
+}
+
+func TestReverseEcho(t *testing.T) {
+	c := &BufferConsole{}
+	c.In.WriteString("ab")
+	v := newEcho(c)
+	v.Journal = 4
+	v.Break = map[uint16]bool{2: true}
+	for v.RunN(-1).Reason() == Breakpoint {
+	}
+	if v.Journalled() != 4 {
+		t.Fatalf("%v instructions journalled, want 4", v.Journalled())
+	}
+	if w, ok := v.LastWrite(32768); !ok || w != (Write{Ip: 0, Counter: 3, Addr: 32768, Old: 'a', New: 'b'}) {
+		t.Errorf("last write to R0 %+v", w)
+	}
+	if _, ok := v.LastWrite(100); ok {
+		t.Errorf("found a write to 100")
+	}
+	if !v.ReverseContinue() || v.Ip != 2 || v.Counter != 4 {
+		t.Fatalf("reverse continue stopped at %v after %v instructions", v.Ip, v.Counter)
+	}
+	if n := v.ReverseStep(5); n != 2 || v.Ip != 4 || v.Registers[0] != 'a' {
+		t.Fatalf("reversed %v instructions to %v with R0 %v", n, v.Ip, v.Registers[0])
+	}
+	v.Break = nil
+	v.RunN(-1)
+	if c.Out.String() != "abb" || v.Registers[0] != 'b' {
+		t.Errorf("printed %q with R0 %v", c.Out.String(), v.Registers[0])
+	}
+}
+
+func TestReverseHook(t *testing.T) {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize), Journal: 10}
+	copy(v.Mem, []uint16{17, 10, 0})
+	v.Hook(10, func(vm *VM) error {
+		vm.Registers[1] = 7
+		vm.Stack = append(vm.Stack, 1, 2)
+		vm.Mem[20] = 3
+		return nil
+	})
+	v.RunN(1)
+	if v.ReverseStep(1) != 1 || v.Ip != 0 || v.Registers[1] != 0 || len(v.Stack) != 0 || v.Mem[20] != 0 {
+		t.Errorf("reversed hooked call to %v, R1 %v, stack %v, Mem[20] %v", v.Ip, v.Registers[1], v.Stack, v.Mem[20])
+	}
+}
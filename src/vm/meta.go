@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetaFunc carries out a meta-command typed at the start of an input line
+// after the VM's Escape prefix. It is called with the machine at the In
+// instruction reading the line, which runs again once it returns. Returning a
+// StopReason stops the machine there; any other error is printed.
+type MetaFunc func(vm *VM, args []string) error
+
+// MetaCommands are the meta-commands understood by every machine.
+var MetaCommands = map[string]MetaFunc{
+	"save": metaSave,
+	"load": metaLoad,
+	"regs": metaRegs,
+	"dbg":  metaDbg,
+	"undo": metaUndo,
+}
+
+// errRetry is returned by In after a meta-command, so that the run carries on
+// from the In again, or from wherever the command left the machine.
+var errRetry = errors.New("retry")
+
+// readInput returns the next byte of input for In. With an Escape prefix set,
+// each line is read whole first so that meta-commands never reach the
+// program.
+func (vm *VM) readInput() (byte, error) {
+	for len(vm.pending) == 0 {
+		if vm.Escape == "" || vm.midLine {
+			return vm.console().ReadByte()
+		}
+		line, err := vm.readLine()
+		if strings.HasPrefix(line, vm.Escape) {
+			vm.Ip -= 2 // back to the In
+			return 0, vm.metaCommand(strings.Fields(line[len(vm.Escape):]))
+		}
+		if line == "" {
+			return 0, err
+		}
+		vm.pending = []byte(line)
+	}
+	c := vm.pending[0]
+	vm.pending = vm.pending[1:]
+	return c, nil
+}
+
+// metaCommand runs the meta-command in fields and returns the error for In.
+func (vm *VM) metaCommand(fields []string) error {
+	vm.prompted = false
+	if len(fields) == 0 {
+		fields = []string{""}
+	}
+	fn := MetaCommands[fields[0]]
+	if fn == nil {
+		var names []string
+		for name := range MetaCommands {
+			names = append(names, vm.Escape+name)
+		}
+		sort.Strings(names)
+		vm.Printf("meta-commands are %v\n", strings.Join(names, ", "))
+		return errRetry
+	}
+	err := fn(vm, fields[1:])
+	vm.prepare()
+	if reason, ok := err.(StopReason); ok {
+		return reason
+	}
+	if err != nil {
+		vm.Printf("%v\n", err)
+	}
+	return errRetry
+}
+
+func metaSave(vm *VM, args []string) error {
+	if len(args) != 1 {
+		vm.Printf("usage %vsave <name>\n", vm.Escape)
+		return nil
+	}
+	return vm.SaveVM(args[0])
+}
+
+// metaLoad loads a snapshot from the Store, or failing that a save file.
+func metaLoad(vm *VM, args []string) error {
+	if len(args) != 1 {
+		vm.Printf("usage %vload <snapshot or save file>\n", vm.Escape)
+		return nil
+	}
+	var err error
+	if vm.Store != nil {
+		err = vm.Checkout(args[0])
+	}
+	if vm.Store == nil || err != nil {
+		if err = vm.LoadVM(args[0]); err != nil {
+			return err
+		}
+	}
+	vm.midLine = false
+	vm.pending = nil
+	vm.checkpointed = false
+	vm.Printf("loaded %v\n", args[0])
+	return nil
+}
+
+func metaRegs(vm *VM, args []string) error {
+	vm.Printf("%v\n", vm.R())
+	return nil
+}
+
+// metaDbg stops the machine with a Breakpoint, for the debugger to take over.
+func metaDbg(vm *VM, args []string) error {
+	return Breakpoint
+}
+
+// metaUndo rolls back turns and reprints what the program showed before the
+// line it rolled back to.
+func metaUndo(vm *VM, args []string) error {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || len(args) > 1 {
+			vm.Printf("usage %vundo [<turns>]\n", vm.Escape)
+			return nil
+		}
+	}
+	output, err := vm.Undo(n)
+	if err != nil {
+		return err
+	}
+	vm.Printf("%v", output)
+	return nil
+}
@@ -0,0 +1,43 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetaCommands(t *testing.T) {
+	out := &bytes.Buffer{}
+	v := newEcho(&ScriptConsole{Lines: []string{"a", "!regs", "!", "!save", "#b"}, Out: out})
+	v.Escape = "!"
+	if r := v.RunN(-1); r.Reason() != InputExhausted {
+		t.Fatalf("stopped with %v", r.Err)
+	}
+	want := "a\n" +
+		"R0:    10, R1:     0, R2:     0, R3:     0, R4:     0, R5:     0, R6:     0, R7:     0, IP:     0\n" +
+		"meta-commands are !dbg, !load, !regs, !save, !undo\n" +
+		"usage !save <name>\n" +
+		"#b\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}
+
+func TestMetaSaveLoad(t *testing.T) {
+	out := &bytes.Buffer{}
+	script := &ScriptConsole{Lines: []string{"a", "!save one", "b", "!load one", "!undo", "!dbg", "c"}, Out: out}
+	v := newEcho(script)
+	v.Escape = "!"
+	v.Checkpoints = 10
+	v.Store = &Store{Dir: t.TempDir()}
+	r := v.RunN(-1)
+	if r.Reason() != Breakpoint || v.Ip != 0 || len(script.Remaining()) != 1 {
+		t.Fatalf("stopped with %v at %v, %v lines left", r.Err, v.Ip, len(script.Remaining()))
+	}
+	v.RunN(-1)
+	saved := out.String()[2:]
+	saved = saved[:strings.IndexByte(saved, '\n')+1]
+	if want := "a\n" + saved + "b\nloaded one\nnothing to undo\nc\n"; out.String() != want || !strings.HasPrefix(saved, "saved one as ") {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,27 @@
+package vm
+
+// PromptFunc is called when the program starts reading a line of input and
+// none is waiting, with everything the program has printed since the previous
+// prompt. It may supply the line, for instance by adding to a BufferConsole.
+// Returning an error stops the machine before the In instruction; returning
+// Prompt stops it with that reason, and the prompt is not repeated when the
+// machine is resumed.
+type PromptFunc func(vm *VM, output string) error
+
+// buffered is implemented by consoles that can tell how much input is waiting.
+type buffered interface {
+	Buffered() int
+}
+
+func (vm *VM) prompt() error {
+	if vm.OnPrompt == nil || vm.midLine || vm.prompted {
+		return nil
+	}
+	if b, ok := vm.console().(buffered); ok && b.Buffered() > 0 {
+		return nil
+	}
+	vm.prompted = true
+	output := string(vm.output)
+	vm.output = vm.output[:0]
+	return vm.OnPrompt(vm, output)
+}
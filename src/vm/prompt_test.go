@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPromptDrivesGame(t *testing.T) {
+	c := &BufferConsole{}
+	v := &VM{Console: c}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	commands := []string{"take tablet", "use tablet"}
+	var outputs []string
+	v.OnPrompt = func(vm *VM, output string) error {
+		outputs = append(outputs, output)
+		if len(commands) == 0 {
+			return Prompt
+		}
+		c.In.WriteString(commands[0] + "\n")
+		commands = commands[1:]
+		return nil
+	}
+	r := v.RunN(-1)
+	if r.Reason() != Prompt || len(outputs) != 3 {
+		t.Fatalf("stopped with %v after %v prompts", r.Err, len(outputs))
+	}
+	for i, want := range []string{"Foothills", "Taken.", "You find yourself writing"} {
+		if !strings.Contains(outputs[i], want) || !strings.HasSuffix(outputs[i], "What do you do?\n") {
+			t.Errorf("prompt %v output %q, want %q", i, outputs[i], want)
+		}
+	}
+	if strings.Contains(outputs[2], "Taken.") {
+		t.Errorf("prompt 2 repeats earlier output: %q", outputs[2])
+	}
+
+	// Resuming does not prompt again for the same line.
+	c.In.WriteString("inv\n")
+	if r := v.RunN(-1); r.Reason() != Prompt || len(outputs) != 4 || !strings.Contains(outputs[3], "Your inventory") {
+		t.Fatalf("resumed run stopped with %v after %v prompts", r.Err, len(outputs))
+	}
+}
+
+func TestPromptPerScriptLine(t *testing.T) {
+	script := &ScriptConsole{Lines: []string{"a", "b"}}
+	v := newEcho(script)
+	var outputs []string
+	v.OnPrompt = func(vm *VM, output string) error {
+		outputs = append(outputs, output)
+		return nil
+	}
+	v.RunN(-1)
+	if strings.Join(outputs, "|") != "|a\n|b\n" {
+		t.Errorf("prompt outputs %q", outputs)
+	}
+}
+
+func TestPromptError(t *testing.T) {
+	c := &BufferConsole{}
+	v := newEcho(c)
+	failed := errors.New("x")
+	v.OnPrompt = func(vm *VM, output string) error {
+		if c.In.Len() == 0 {
+			return failed
+		}
+		return nil
+	}
+	r := v.RunN(-1)
+	if r.Reason() != Failed || !errors.Is(r.Err, failed) || v.Ip != 0 {
+		t.Fatalf("stopped with %v at %v", r.Err, v.Ip)
+	}
+	// The next prompt fails again, once the line has been echoed.
+	c.In.WriteString("a\n")
+	if r := v.RunN(-1); r.Reason() != Failed || v.Ip != 0 || c.Out.String() != "a\n" {
+		t.Fatalf("resumed run stopped with %v, printed %q", r.Err, c.Out.String())
+	}
+}
@@ -0,0 +1,394 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// instr is a decoded instruction, cached per address in VM.code. A zero size
+// means the address has not been decoded since it was last written.
+type instr struct {
+	size      uint8
+	op        uint8
+	writesMem bool
+	dest      uint16
+	words     [3]uint16
+}
+
+func (in *instr) codes() []uint16 {
+	return append([]uint16{uint16(in.op)}, in.words[:in.size-1]...)
+}
+
+// Result reports how a synchronous run ended. Err is nil if the requested
+// number of instructions was executed, and otherwise a *StopError.
+type Result struct {
+	Executed int
+	Err      error
+}
+
+func (r Result) Reason() StopReason {
+	var stop *StopError
+	if errors.As(r.Err, &stop) {
+		return stop.Reason
+	}
+	return 0
+}
+
+// Invalidate discards every cached decoded instruction and compiled block. It
+// must be called after changing Mem other than by running the machine.
+func (vm *VM) Invalidate() {
+	vm.code = nil
+	vm.blocks = nil
+	vm.heat = nil
+	vm.covered = nil
+	vm.dirty = nil
+}
+
+// invalidate discards the cached instructions that overlap addr.
+func (vm *VM) invalidate(addr uint16) {
+	for a := int(addr) - 3; a <= int(addr); a++ {
+		if a >= 0 && a < len(vm.code) {
+			vm.code[a].size = 0
+		}
+	}
+	if int(addr) < len(vm.covered) && vm.covered[addr] {
+		vm.flushBlocks(addr)
+	}
+}
+
+func first(s []uint16) *uint16 {
+	if len(s) == 0 {
+		return nil
+	}
+	return &s[0]
+}
+
+// prepare makes sure the instruction cache and compiled blocks match the
+// current Mem and Registers slices, which they hold pointers into.
+func (vm *VM) prepare() {
+	if len(vm.code) != len(vm.Mem) || vm.codeMem != first(vm.Mem) || vm.codeRegs != first(vm.Registers) {
+		vm.Invalidate()
+		vm.code = make([]instr, len(vm.Mem))
+		vm.codeMem = first(vm.Mem)
+		vm.codeRegs = first(vm.Registers)
+	}
+}
+
+// bind points args at the operands of the decoded instruction at ip.
+func (vm *VM) bind(ip uint16, in *instr, args []*uint16) {
+	kinds := Ops[in.op].Args
+	for i := range args {
+		w := in.words[i]
+		if w > 32767 {
+			args[i] = &vm.Registers[w-32768]
+		} else if kinds[i] == 'L' {
+			args[i] = &vm.Mem[w]
+		} else {
+			args[i] = &vm.Mem[int(ip)+1+i]
+		}
+	}
+}
+
+func (vm *VM) decode(ip uint16) error {
+	in, err := vm.decodeInstr(ip)
+	if err != nil {
+		return err
+	}
+	vm.code[ip] = in
+	return nil
+}
+
+func (vm *VM) decodeInstr(ip uint16) (instr, error) {
+	o := vm.Mem[ip]
+	if o >= uint16(len(Ops)) {
+		return instr{}, &StopError{Reason: BadOpcode, Ip: ip, Word: o, Codes: []uint16{o}}
+	}
+	args := Ops[o].Args
+	in := instr{size: uint8(1 + len(args)), op: uint8(o)}
+	for i := range args {
+		p := int(ip) + 1 + i
+		if p >= len(vm.Mem) {
+			return instr{}, &StopError{Reason: BadAddress, Ip: ip, Codes: append([]uint16(nil), vm.Mem[ip:p]...)}
+		}
+		w := vm.Mem[p]
+		if w >= 32776 {
+			return instr{}, &StopError{Reason: InvalidOperand, Ip: ip, Word: w, Codes: append([]uint16(nil), vm.Mem[ip:p+1]...)}
+		}
+		if args[i] == 'L' && w <= 32767 && int(w) >= len(vm.Mem) {
+			return instr{}, &StopError{Reason: BadAddress, Ip: ip, Codes: append([]uint16(nil), vm.Mem[ip:p+1]...)}
+		}
+		in.words[i] = w
+	}
+	if len(args) > 0 && in.words[0] <= 32767 {
+		if args[0] == 'L' {
+			in.writesMem, in.dest = true, in.words[0]
+		} else if Ops[o].Name == "In" { // In writes through its 'R' operand
+			in.writesMem, in.dest = true, ip+1
+		}
+	}
+	return in, nil
+}
+
+// step executes the instruction at Ip. On input exhaustion or a fault the Ip
+// is left on the instruction so the machine can be resumed.
+func (vm *VM) step() error {
+	ip := vm.Ip
+	if int(ip) >= len(vm.Mem) {
+		return &StopError{Reason: BadAddress, Ip: ip}
+	}
+	in := &vm.code[ip]
+	if in.size == 0 {
+		if err := vm.decode(ip); err != nil {
+			return err
+		}
+	}
+	if vm.meta.ExecMem != nil {
+		vm.meta.ExecMem[ip] = true
+	}
+	if in.writesMem {
+		vm.OwnMem()
+	}
+	args := vm.args[:in.size-1]
+	vm.bind(ip, in, args)
+	var e journalEntry
+	if vm.Journal > 0 {
+		e = vm.record(ip, in, args)
+	}
+	vm.Ip = ip + uint16(in.size)
+	if err := Ops[in.op].Function(vm, args); err != nil {
+		return vm.stopped(ip, in.codes(), err)
+	}
+	if in.writesMem {
+		vm.invalidate(in.dest)
+	}
+	if vm.Journal > 0 {
+		vm.remember(e)
+	}
+	vm.Counter++
+	return nil
+}
+
+// stopped turns an error returned by the instruction at ip into the
+// *StopError reported by a run. Ip is left on the instruction so that it can
+// be retried, except after a halt.
+func (vm *VM) stopped(ip uint16, codes []uint16, err error) error {
+	if err == errRetry {
+		return nil
+	}
+	if err == Halted {
+		vm.Counter++
+		return &StopError{Reason: Halted, Ip: ip, Codes: codes}
+	}
+	if err == io.EOF {
+		vm.Ip = ip
+		return &StopError{Reason: InputExhausted, Ip: ip, Codes: codes, Err: err}
+	}
+	vm.Ip = ip
+	if reason, ok := err.(StopReason); ok {
+		return &StopError{Reason: reason, Ip: ip, Codes: codes}
+	}
+	var stop *StopError
+	if errors.As(err, &stop) {
+		return err
+	}
+	return &StopError{Reason: Failed, Ip: ip, Codes: codes, Err: err}
+}
+
+func (vm *VM) breakpoint() bool {
+	if vm.Break[vm.Ip] {
+		return true
+	}
+	return int(vm.Ip) < len(vm.Mem) && vm.BreakOps[vm.Mem[vm.Ip]]
+}
+
+func (vm *VM) armed() bool {
+	for _, b := range vm.Break {
+		if b {
+			return true
+		}
+	}
+	for _, b := range vm.BreakOps {
+		if b {
+			return true
+		}
+	}
+	return false
+}
+
+// Interrupt makes a running machine stop with reason Interrupted before its
+// next instruction, or its next basic block under the JIT. It is safe to call
+// from another goroutine.
+func (vm *VM) Interrupt() {
+	atomic.StoreInt32(&vm.interrupted, 1)
+}
+
+// RunN executes at most n instructions, or until the machine stops if n is
+// negative. Breakpoints are checked before every instruction but the first, so
+// a run stopped at a breakpoint can be resumed by calling RunN again. Console
+// output is flushed before RunN returns.
+func (vm *VM) RunN(n int) Result {
+	vm.prepare()
+	armed := vm.armed()
+	jit := vm.JIT && !armed && vm.Journal == 0
+	start := vm.Counter
+	var err error
+	for n < 0 || vm.Counter-start < n {
+		if atomic.LoadInt32(&vm.interrupted) != 0 {
+			atomic.StoreInt32(&vm.interrupted, 0)
+			err = &StopError{Reason: Interrupted, Ip: vm.Ip}
+			break
+		}
+		if armed && vm.Counter != start && vm.breakpoint() {
+			err = &StopError{Reason: Breakpoint, Ip: vm.Ip}
+			break
+		}
+		if jit {
+			b := vm.block(vm.Ip)
+			if b != nil && (n < 0 || n-(vm.Counter-start) >= len(b.ops)) {
+				if err = vm.runBlock(b); err != nil {
+					break
+				}
+				continue
+			}
+		}
+		if err = vm.step(); err != nil {
+			break
+		}
+	}
+	vm.Flush()
+	return Result{Executed: vm.Counter - start, Err: err}
+}
+
+// SingleStep executes exactly one instruction.
+func (vm *VM) SingleStep() Result {
+	return vm.RunN(1)
+}
+
+// RunContext executes until the machine stops, max instructions have been
+// executed or ctx is done, whichever comes first; a negative max means no
+// limit. Running out of instructions stops with reason BudgetExhausted and
+// ctx being done with reason Cancelled, and either way the machine can be
+// resumed where it left off.
+func (vm *VM) RunContext(ctx context.Context, max int) Result {
+	if err := ctx.Err(); err != nil {
+		return Result{Err: &StopError{Reason: Cancelled, Ip: vm.Ip, Err: err}}
+	}
+	fired := make(chan bool)
+	stop := context.AfterFunc(ctx, func() {
+		vm.Interrupt()
+		close(fired)
+	})
+	r := vm.RunN(max)
+	if !stop() {
+		// Don't leave the interrupt pending for the next run.
+		<-fired
+		atomic.StoreInt32(&vm.interrupted, 0)
+		if r.Err == nil || errors.Is(r.Err, Interrupted) {
+			r.Err = &StopError{Reason: Cancelled, Ip: vm.Ip, Err: ctx.Err()}
+		}
+	}
+	if r.Err == nil && max >= 0 {
+		r.Err = &StopError{Reason: BudgetExhausted, Ip: vm.Ip}
+	}
+	return r
+}
+
+// Run executes until the program halts, returning nil on a normal halt.
+func (vm *VM) Run() error {
+	r := vm.RunN(-1)
+	if errors.Is(r.Err, Halted) {
+		return nil
+	}
+	return r.Err
+}
+
+// Serve runs the machine under the control of ControlChan, reporting every
+// stop to Debug or Finish. SIGUSR1 saves the machine and carries on, and
+// SIGINT pauses it for the debugger. A SIGINT with no debugger attached, or a
+// second one before the machine has been resumed, exits the program.
+func (vm *VM) Serve() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGINT)
+	defer signal.Stop(sigChan)
+	received := make(chan os.Signal, 8)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == syscall.SIGINT && (atomic.LoadInt32(&vm.attached) == 0 || atomic.SwapInt32(&vm.sigint, 1) == 1) {
+					signal.Reset(syscall.SIGINT)
+					syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+					return
+				}
+				received <- sig
+				vm.Interrupt()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	pause := func() bool {
+		vm.ControlChan <- &StopError{Reason: Breakpoint, Ip: vm.Ip}
+		_, ok := <-vm.ControlChan
+		atomic.StoreInt32(&vm.sigint, 0)
+		return ok
+	}
+	vm.Counter = 0
+	if !pause() {
+		return
+	}
+	for {
+		n := -1
+		if vm.Step {
+			n = 1
+		}
+		err := vm.RunN(n).Err
+		if errors.Is(err, Interrupted) {
+			var saved, dbg bool
+		drain:
+			for {
+				select {
+				case sig := <-received:
+					if sig == syscall.SIGUSR1 {
+						vm.SaveVM("SIG")
+						saved = true
+					} else {
+						vm.Printf("SIGNAL RECEIVED %v\n", sig)
+						dbg = true
+					}
+				default:
+					break drain
+				}
+			}
+			if saved && !dbg {
+				continue
+			}
+			err = nil
+		}
+		if errors.Is(err, InputExhausted) {
+			if vm.Debugging {
+				vm.Step = true
+				err = nil
+			} else if vm.SaveOnEOF {
+				vm.SaveVM("EOF")
+			}
+		}
+		if err == nil || errors.Is(err, Breakpoint) {
+			if !pause() {
+				return
+			}
+			continue
+		}
+		vm.ControlChan <- err
+		<-vm.ControlChan
+		return
+	}
+}
@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacyRun is the interpreter loop as it was before instructions were
+// cached: a full Decode, a signal select and three breakpoint lookups for
+// every instruction. It is kept as the baseline for the benchmarks.
+func legacyRun(vm *VM) error {
+	saveSigChan := make(chan os.Signal, 1)
+	dbgSigChan := make(chan os.Signal, 1)
+	for {
+		opIp := vm.Ip
+		select {
+		case <-saveSigChan:
+		case <-dbgSigChan:
+		default:
+		}
+		if vm.BreakOps[vm.Mem[vm.Ip]] || vm.Step || vm.Break[vm.Ip] {
+			return Breakpoint
+		}
+		vm.meta.ExecMem[vm.Ip] = true
+		dOp, good := vm.Decode(&vm.Ip, false)
+		if !good {
+			return BadOpcode
+		}
+		vm.Counter++
+		err := dOp.Function(vm, dOp.Args)
+		if err != nil {
+			if err == io.EOF {
+				vm.Ip = opIp
+			}
+			return err
+		}
+	}
+}
+
+func newBenchVM(b *testing.B, mem []uint16) *VM {
+	v := &VM{
+		Stdout:   ioutil.Discard,
+		Stdin:    bufio.NewReader(strings.NewReader("")),
+		Break:    make(map[uint16]bool),
+		BreakOps: make(map[uint16]bool),
+	}
+	if mem == nil {
+		if err := v.Load("../../challenge.bin"); err != nil {
+			b.Skip(err)
+		}
+	} else {
+		v.Registers = make([]uint16, 8)
+		v.Mem = make([]uint16, MemSize)
+		copy(v.Mem, mem)
+	}
+	v.meta.ReadMem = make([]bool, MemSize)
+	v.meta.WriteMem = make([]bool, MemSize)
+	v.meta.ExecMem = make([]bool, MemSize)
+	v.meta.Functions = make(map[uint16]bool)
+	return v
+}
+
+// countdown decrements R0 from 30000 to zero and halts.
+var countdown = []uint16{
+	1, 32768, 30000, // set R0 30000
+	9, 32768, 32768, 32767, // add R0 R0 -1
+	7, 32768, 3, // jt R0 3
+	0, // halt
+}
+
+func benchmark(b *testing.B, mem []uint16, run func(*VM) error) {
+	b.ReportAllocs()
+	instructions := 0
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		v := newBenchVM(b, mem)
+		b.StartTimer()
+		run(v)
+		instructions += v.Counter
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(instructions), "ns/instr")
+}
+
+func BenchmarkBootLegacy(b *testing.B) {
+	benchmark(b, nil, legacyRun)
+}
+
+func BenchmarkBoot(b *testing.B) {
+	benchmark(b, nil, (*VM).Run)
+}
+
+func BenchmarkCountdownLegacy(b *testing.B) {
+	benchmark(b, countdown, legacyRun)
+}
+
+func BenchmarkCountdown(b *testing.B) {
+	benchmark(b, countdown, (*VM).Run)
+}
+
+func runJIT(v *VM) error {
+	v.JIT = true
+	return v.Run()
+}
+
+func BenchmarkBootJIT(b *testing.B) {
+	benchmark(b, nil, runJIT)
+}
+
+func BenchmarkCountdownJIT(b *testing.B) {
+	benchmark(b, countdown, runJIT)
+}
+
+func TestRunContext(t *testing.T) {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize)}
+	copy(v.Mem, []uint16{
+		9, 32768, 32768, 1, // add R0 R0 1
+		6, 0, // jmp 0
+	})
+	for _, jit := range []bool{false, true} {
+		v.JIT = jit
+		v.Registers[0], v.Counter, v.Ip = 0, 0, 0
+		r := v.RunContext(context.Background(), 1001)
+		if r.Reason() != BudgetExhausted || r.Executed != 1001 || v.Registers[0] != 501 {
+			t.Fatalf("jit %v: budget run stopped with %v after %v instructions, R0 %v", jit, r.Err, r.Executed, v.Registers[0])
+		}
+		if r := v.RunContext(context.Background(), 1); r.Reason() != BudgetExhausted || v.Registers[0] != 501 || v.Ip != 0 {
+			t.Fatalf("jit %v: resumed at %v with R0 %v", jit, v.Ip, v.Registers[0])
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		r = v.RunContext(ctx, -1)
+		cancel()
+		if r.Reason() != Cancelled || !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Fatalf("jit %v: cancelled run stopped with %v", jit, r.Err)
+		}
+		if r := v.RunN(5); r.Err != nil || r.Executed != 5 {
+			t.Fatalf("jit %v: run after cancel stopped with %v", jit, r.Err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A save file is saveMagic, a little-endian uint32 format version and the
+// payload length, the gob-encoded payload, and the SHA-256 of the payload.
+// Files without the magic are read as the bare gob-encoded State that SaveVM
+// used to write.
+const (
+	saveMagic   = "SYNACOR\x00"
+	SaveVersion = 1
+)
+
+// SaveInfo describes a save. Program is the SHA-256 of the program image the
+// machine was loaded from, if known. Parent is the id of the snapshot in a
+// Store the save was made from, and Input what the program read since.
+// Legacy saves have Version 0 and only their State.
+type SaveInfo struct {
+	Version int
+	Program string
+	Created time.Time
+	Label   string
+	Notes   string
+	Tags    []string
+	Counter int
+	Parent  string
+	Input   string
+}
+
+// Save is the content of a save file.
+type Save struct {
+	SaveInfo
+	State State
+}
+
+// savePayload is what version 1 encodes.
+type savePayload struct {
+	Info  SaveInfo
+	State State
+}
+
+// Snapshot returns a save of vm's current state with the given label.
+func (vm *VM) Snapshot(label string) *Save {
+	s := vm.Clone().State
+	return &Save{
+		SaveInfo: SaveInfo{
+			Version: SaveVersion,
+			Program: vm.Program,
+			Created: time.Now(),
+			Label:   label,
+			Counter: vm.Counter,
+		},
+		State: s,
+	}
+}
+
+// Write writes s in the current save format.
+func (s *Save) Write(w io.Writer) error {
+	var payload bytes.Buffer
+	info := s.SaveInfo
+	info.Version = SaveVersion
+	if err := gob.NewEncoder(&payload).Encode(savePayload{info, s.State}); err != nil {
+		return err
+	}
+	header := make([]byte, len(saveMagic)+8)
+	copy(header, saveMagic)
+	binary.LittleEndian.PutUint32(header[len(saveMagic):], SaveVersion)
+	binary.LittleEndian.PutUint32(header[len(saveMagic)+4:], uint32(payload.Len()))
+	sum := sha256.Sum256(payload.Bytes())
+	for _, b := range [][]byte{header, payload.Bytes(), sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSave reads a save in any format SaveVM has written.
+func ReadSave(r io.Reader) (*Save, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(saveMagic)) {
+		s := &Save{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s.State); err != nil {
+			return nil, fmt.Errorf("not a save file: %v", err)
+		}
+		return s, nil
+	}
+	data = data[len(saveMagic):]
+	if len(data) < 8 {
+		return nil, fmt.Errorf("truncated save header")
+	}
+	version := binary.LittleEndian.Uint32(data)
+	n := int(binary.LittleEndian.Uint32(data[4:]))
+	data = data[8:]
+	if version != SaveVersion {
+		return nil, fmt.Errorf("unsupported save version %v", version)
+	}
+	if len(data) != n+sha256.Size {
+		return nil, fmt.Errorf("truncated save: %v bytes of payload and checksum, want %v", len(data), n+sha256.Size)
+	}
+	if sum := sha256.Sum256(data[:n]); !bytes.Equal(sum[:], data[n:]) {
+		return nil, fmt.Errorf("save checksum mismatch")
+	}
+	var p savePayload
+	if err := gob.NewDecoder(bytes.NewReader(data[:n])).Decode(&p); err != nil {
+		return nil, err
+	}
+	p.Info.Version = int(version)
+	return &Save{SaveInfo: p.Info, State: p.State}, nil
+}
+
+// ReadSaveFile reads the save in file fn. A legacy save is given the label
+// and creation time in its name, as SaveVM named it.
+func ReadSaveFile(fn string) (*Save, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("%v \"%v\"", err, fn)
+	}
+	defer file.Close()
+	s, err := ReadSave(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v \"%v\"", err, fn)
+	}
+	if s.Version == 0 {
+		name := filepath.Base(fn)
+		for i, c := range name {
+			if c != '-' {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, name[i+1:]); err == nil {
+				s.Label, s.Created = name[:i], t
+				break
+			}
+		}
+	}
+	return s, nil
+}
+
+// WriteSaveFile writes s to file fn.
+func WriteSaveFile(fn string, s *Save) error {
+	file, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// programHash returns the hex SHA-256 of a program image.
+func programHash(image []byte) string {
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveVM saves the machine to a file named name-<time>, labelled name, or
+// commits it to the machine's Store if it has one.
+func (vm *VM) SaveVM(name string) error {
+	if vm.Store != nil {
+		id, err := vm.Commit(name)
+		if err == nil {
+			vm.Printf("saved %v as %v\n", name, ShortID(id))
+		}
+		return err
+	}
+	s := vm.Snapshot(name)
+	fn := fmt.Sprintf("%v-%v", name, s.Created.Format(time.RFC3339))
+	vm.Printf("saving to %v\n", fn)
+	return WriteSaveFile(fn, s)
+}
+
+// LoadVM restores the machine from a save file written by SaveVM.
+func (vm *VM) LoadVM(fn string) error {
+	s, err := ReadSaveFile(fn)
+	if err != nil {
+		return err
+	}
+	return vm.Restore(s)
+}
+
+// Restore puts the machine in the state recorded by s.
+func (vm *VM) Restore(s *Save) error {
+	if len(s.State.Mem) > MemSize {
+		return fmt.Errorf("saved memory too large")
+	}
+	if len(s.State.Registers) != 8 {
+		return fmt.Errorf("save has %v registers", len(s.State.Registers))
+	}
+	if s.State.Ip >= MemSize {
+		return fmt.Errorf("saved ip %v is outside memory", s.State.Ip)
+	}
+	if len(s.State.CallStack)%2 != 0 {
+		return fmt.Errorf("saved call stack has odd length %v", len(s.State.CallStack))
+	}
+	vm.Invalidate()
+	// s keeps its memory, which is shared copy-on-write.
+	vm.State = State{
+		Mem:       s.State.Mem,
+		Registers: append([]uint16(nil), s.State.Registers...),
+		Stack:     append([]uint16(nil), s.State.Stack...),
+		CallStack: append([]uint16(nil), s.State.CallStack...),
+		Ip:        s.State.Ip,
+	}
+	vm.memShared = true
+	if len(vm.Mem) < MemSize {
+		vm.Mem = append(make([]uint16, 0, MemSize), vm.Mem...)[:MemSize]
+		vm.memShared = false
+	}
+	vm.Program = s.Program
+	vm.Counter = s.Counter
+	vm.ClearJournal()
+	// Turns played before the save was loaded can't be undone into.
+	vm.ring = nil
+	vm.turn = vm.turn[:0]
+	return nil
+}
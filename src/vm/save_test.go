@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveRoundTrip(t *testing.T) {
+	v := &VM{Console: &BufferConsole{}}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	v.RunN(-1)
+	s := v.Snapshot("start")
+	s.Notes = "first prompt"
+	var buf bytes.Buffer
+	if err := s.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSave(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != SaveVersion || got.Label != "start" || got.Notes != "first prompt" ||
+		got.Program != v.Program || got.Counter != v.Counter || !got.Created.Equal(s.Created) {
+		t.Errorf("read back %+v, wrote %+v", got.SaveInfo, s.SaveInfo)
+	}
+	if fmt.Sprint(got.State) != fmt.Sprint(v.State) {
+		t.Errorf("state changed in the round trip")
+	}
+	if c := v.Clone().Snapshot("clone"); c.Program == "" || c.Program != v.Program {
+		t.Errorf("clone's snapshot has program %q, want %q", c.Program, v.Program)
+	}
+
+	data := buf.Bytes()
+	data[len(data)/2] ^= 1
+	if _, err := ReadSave(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("corrupt save read with error %v", err)
+	}
+	data[len(saveMagic)] = 2
+	if _, err := ReadSave(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("future save read with error %v", err)
+	}
+	if _, err := ReadSave(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Errorf("truncated save read")
+	}
+}
+
+func TestReadLegacySave(t *testing.T) {
+	s, err := ReadSaveFile("../../the-beach-2016-01-14T13:14:14-05:00")
+	if err != nil {
+		t.Skip(err)
+	}
+	if s.Version != 0 || len(s.State.Mem) == 0 || len(s.State.Registers) != 8 {
+		t.Errorf("legacy save read as version %v with %v words and registers %v", s.Version, len(s.State.Mem), s.State.Registers)
+	}
+	if s.Label != "the-beach" || s.Created.Format(time.RFC3339) != "2016-01-14T13:14:14-05:00" {
+		t.Errorf("legacy save labelled %q, created %v", s.Label, s.Created)
+	}
+}
+
+func TestRestoreKeepsSave(t *testing.T) {
+	v := &VM{Console: &BufferConsole{}}
+	if err := v.LoadVM("../../the-beach-2016-01-14T13:14:14-05:00"); err != nil {
+		t.Skip(err)
+	}
+	s := v.Snapshot("beach")
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		c := &BufferConsole{}
+		c.In.WriteString("take tablet\ndrop tablet\nlook\n")
+		w := &VM{Console: c}
+		if err := w.Restore(s); err != nil {
+			t.Fatal(err)
+		}
+		w.RunN(-1)
+		outputs = append(outputs, c.Out.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("second restore of a save printed\n%v\nfirst\n%v", outputs[1], outputs[0])
+	}
+}
+
+func TestRestoreRejectsBadState(t *testing.T) {
+	for _, st := range []State{
+		{Registers: make([]uint16, 3)},
+		{Registers: make([]uint16, 8), Ip: MemSize},
+		{Registers: make([]uint16, 8), Stack: []uint16{3}, CallStack: []uint16{7}},
+	} {
+		v := &VM{}
+		if err := v.Restore(&Save{State: st}); err == nil {
+			t.Errorf("restored a save with %v registers at %v, call stack %v", len(st.Registers), st.Ip, st.CallStack)
+		}
+	}
+}
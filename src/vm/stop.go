@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// StopReason says why the machine stopped. It is itself an error so it can be
+// used as a target for errors.Is.
+type StopReason int
+
+const (
+	Halted StopReason = iota + 1
+	InputExhausted
+	Breakpoint
+	BadOpcode
+	InvalidOperand
+	StackUnderflow
+	DivideByZero
+	BadAddress
+	Interrupted
+	BudgetExhausted
+	Cancelled
+	Prompt
+	Failed
+)
+
+var stopReasonNames = map[StopReason]string{
+	Halted:          "halt",
+	InputExhausted:  "eof",
+	Breakpoint:      "break",
+	BadOpcode:       "bad op",
+	InvalidOperand:  "invalid operand",
+	StackUnderflow:  "stack underflow",
+	DivideByZero:    "divide by zero",
+	BadAddress:      "bad address",
+	Interrupted:     "interrupted",
+	BudgetExhausted: "budget exhausted",
+	Cancelled:       "cancelled",
+	Prompt:          "prompt",
+	Failed:          "failed",
+}
+
+func (r StopReason) Error() string {
+	if name, ok := stopReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("stop reason %d", int(r))
+}
+
+func (r StopReason) String() string {
+	return r.Error()
+}
+
+// StopError is returned whenever execution stops, recording where it stopped.
+// Codes holds the words of the instruction at Ip as far as they could be
+// decoded, Word is the offending word for BadOpcode and InvalidOperand, and
+// Err is the underlying error, if any (io.EOF for InputExhausted, the
+// context's error for Cancelled, and whatever a prompt function, hook or
+// console returned for Failed).
+//
+// A fault leaves Ip on the faulting instruction and the rest of the state as
+// it was before that instruction ran.
+type StopError struct {
+	Reason StopReason
+	Ip     uint16
+	Word   uint16
+	Codes  []uint16
+	Err    error
+}
+
+func (e *StopError) Error() string {
+	switch e.Reason {
+	case BadOpcode, InvalidOperand:
+		return fmt.Sprintf("%v %v at %v", e.Reason, e.Word, e.Ip)
+	case DivideByZero, StackUnderflow, BadAddress:
+		return fmt.Sprintf("%v at %v %v", e.Reason, e.Ip, e.Codes)
+	case Failed:
+		return fmt.Sprintf("%v at %v: %v", e.Reason, e.Ip, e.Err)
+	}
+	return fmt.Sprintf("%v at %v", e.Reason, e.Ip)
+}
+
+func (e *StopError) Is(target error) bool {
+	return target == e.Reason
+}
+
+func (e *StopError) Unwrap() error {
+	return e.Err
+}
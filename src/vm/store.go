@@ -0,0 +1,223 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Store is a directory of saves named by the hash of their State, so that a
+// state is only stored once. Each save records the snapshot it was made from
+// and the input read since, which makes the store a tree of the paths taken
+// through the game.
+type Store struct {
+	Dir string
+}
+
+// OpenStore returns the store in dir, creating the directory if needed.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// StateHash returns the hex SHA-256 of a state's contents. Trailing zero
+// words of Mem don't count, so a save with short memory hashes the same as
+// once it is loaded.
+func StateHash(st *State) string {
+	mem := st.Mem
+	for len(mem) > 0 && mem[len(mem)-1] == 0 {
+		mem = mem[:len(mem)-1]
+	}
+	h := sha256.New()
+	for _, s := range [][]uint16{mem, st.Registers, st.Stack, st.CallStack, {st.Ip}} {
+		binary.Write(h, binary.LittleEndian, uint32(len(s)))
+		binary.Write(h, binary.LittleEndian, s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Put adds s to the store and returns its id. If the state is already stored
+// the existing snapshot, with its parent and label, is kept.
+func (st *Store) Put(s *Save) (string, error) {
+	id := StateHash(&s.State)
+	fn := filepath.Join(st.Dir, id)
+	if _, err := os.Stat(fn); err == nil {
+		return id, nil
+	}
+	tmp := fn + ".tmp"
+	if err := WriteSaveFile(tmp, s); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return id, os.Rename(tmp, fn)
+}
+
+// Resolve returns the id of the snapshot named by ref: an id, a unique
+// prefix of one, or the label of the most recent snapshot with that label.
+func (st *Store) Resolve(ref string) (string, error) {
+	ids, err := st.IDs()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, ref) {
+			found = append(found, id)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("snapshot %v is ambiguous", ref)
+	}
+	all, err := st.List()
+	if err != nil {
+		return "", err
+	}
+	var latest *Save
+	var latestID string
+	for id, s := range all {
+		if s.Label == ref && (latest == nil || s.Created.After(latest.Created)) {
+			latest, latestID = s, id
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no snapshot %v", ref)
+	}
+	return latestID, nil
+}
+
+// Get reads the snapshot named by ref.
+func (st *Store) Get(ref string) (*Save, string, error) {
+	id, err := st.Resolve(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	s, err := ReadSaveFile(filepath.Join(st.Dir, id))
+	return s, id, err
+}
+
+// IDs returns the ids of every snapshot in the store.
+func (st *Store) IDs() ([]string, error) {
+	infos, err := ioutil.ReadDir(st.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		if len(info.Name()) == sha256.Size*2 && info.Mode().IsRegular() {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
+
+// List reads every snapshot in the store.
+func (st *Store) List() (map[string]*Save, error) {
+	ids, err := st.IDs()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]*Save, len(ids))
+	for _, id := range ids {
+		s, err := ReadSaveFile(filepath.Join(st.Dir, id))
+		if err != nil {
+			return nil, err
+		}
+		all[id] = s
+	}
+	return all, nil
+}
+
+// ShortID abbreviates a snapshot id for display.
+func ShortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Tree writes the snapshots as a tree, each under its parent with the input
+// that led to it.
+func (st *Store) Tree(w io.Writer) error {
+	all, err := st.List()
+	if err != nil {
+		return err
+	}
+	children := map[string][]string{}
+	for id, s := range all {
+		parent := s.Parent
+		if all[parent] == nil {
+			parent = ""
+		}
+		children[parent] = append(children[parent], id)
+	}
+	for _, ids := range children {
+		sort.Slice(ids, func(i, j int) bool {
+			return all[ids[i]].Created.Before(all[ids[j]].Created)
+		})
+	}
+	var walk func(parent, indent string)
+	walk = func(parent, indent string) {
+		for _, id := range children[parent] {
+			s := all[id]
+			fmt.Fprintf(w, "%v%v", indent, ShortID(id))
+			if s.Label != "" {
+				fmt.Fprintf(w, " [%v]", s.Label)
+			}
+			if s.Input != "" {
+				fmt.Fprintf(w, " %q", s.Input)
+			}
+			fmt.Fprintf(w, " %v\n", s.Created.Format("2006-01-02 15:04:05"))
+			walk(id, indent+"  ")
+		}
+	}
+	walk("", "")
+	return nil
+}
+
+// Commit snapshots the machine into its Store with the given label, as a
+// child of the snapshot it was last committed to or checked out from, and
+// returns the new snapshot's id.
+func (vm *VM) Commit(label string) (string, error) {
+	if vm.Store == nil {
+		return "", fmt.Errorf("no snapshot store")
+	}
+	s := vm.Snapshot(label)
+	s.Parent = vm.Head
+	s.Input = string(vm.input)
+	id, err := vm.Store.Put(s)
+	if err != nil {
+		return "", err
+	}
+	vm.Head = id
+	vm.input = vm.input[:0]
+	return id, nil
+}
+
+// Checkout restores the machine from the snapshot in its Store named by ref.
+func (vm *VM) Checkout(ref string) error {
+	if vm.Store == nil {
+		return fmt.Errorf("no snapshot store")
+	}
+	s, id, err := vm.Store.Get(ref)
+	if err != nil {
+		return err
+	}
+	if err := vm.Restore(s); err != nil {
+		return err
+	}
+	vm.Head = id
+	vm.input = vm.input[:0]
+	return nil
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &BufferConsole{}
+	v := &VM{Console: c, Store: store}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	play := func(input string) {
+		c.In.WriteString(input)
+		v.RunN(-1)
+	}
+	commit := func(label string) string {
+		id, err := v.Commit(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	play("")
+	start := commit("start")
+	play("take tablet\n")
+	tablet := commit("tablet")
+	if err := v.Checkout("start"); err != nil {
+		t.Fatal(err)
+	}
+	play("take tablet\n")
+	if id := commit("again"); id != tablet {
+		t.Errorf("the same state was stored twice")
+	}
+	if err := v.Checkout(start[:8]); err != nil {
+		t.Fatal(err)
+	}
+	play("doorway\n")
+	commit("cave")
+
+	ids, _ := store.IDs()
+	if len(ids) != 3 {
+		t.Errorf("store has %v snapshots, want 3", len(ids))
+	}
+	s, _, err := store.Get("cave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Parent != start || s.Input != "doorway\n" {
+		t.Errorf("cave has parent %v and input %q", ShortID(s.Parent), s.Input)
+	}
+	var tree bytes.Buffer
+	store.Tree(&tree)
+	lines := strings.Split(strings.TrimSpace(tree.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "[start]") ||
+		!strings.HasPrefix(lines[1], "  ") || !strings.Contains(lines[1], `[tablet] "take tablet\n"`) ||
+		!strings.Contains(lines[2], `[cave] "doorway\n"`) {
+		t.Errorf("tree\n%v", tree.String())
+	}
+}
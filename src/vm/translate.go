@@ -0,0 +1,385 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+)
+
+// Translate writes Go source for the function at entry and every function it
+// calls with a literal address. The generated Machine type has the same
+// register, stack and memory semantics as the Ops table: a Call pushes its
+// return address, a Ret pops it and the caller checks it came back to the
+// right place. Indirect calls and jumps can only reach translated code. The
+// code is a snapshot of Mem, so programs that modify the translated functions
+// at run time are not supported.
+func (vm *VM) Translate(w io.Writer, pkg string, entry uint16) error {
+	t := &translator{vm: vm, funcs: map[uint16]*tfunc{}}
+	t.queue = append(t.queue, entry)
+	for len(t.queue) > 0 {
+		addr := t.queue[0]
+		t.queue = t.queue[1:]
+		if t.funcs[addr] == nil {
+			t.funcs[addr] = t.discover(addr)
+		}
+	}
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by translate from function %v; DO NOT EDIT.\n\n", entry)
+	fmt.Fprintf(&src, "package %v\n%v", pkg, translateRuntime)
+	fmt.Fprintf(&src, "\nfunc (m *Machine) Call%v() (err error) {\n", entry)
+	fmt.Fprintf(&src, "defer m.recover(&err)\nm.Stack = append(m.Stack, 0)\n")
+	fmt.Fprintf(&src, "if m.f%v() != 0 {\npanic(&Stop{\"bad return\", %v})\n}\nreturn nil\n}\n", entry, entry)
+	var addrs []int
+	for addr := range t.funcs {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		t.emit(&src, t.funcs[uint16(addr)])
+	}
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting translation: %v", err)
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+const translateRuntime = `
+import (
+	"fmt"
+	"io"
+)
+
+// Machine holds the registers, stack and memory of the translated program.
+type Machine struct {
+	R     [8]uint16
+	Stack []uint16
+	Mem   []uint16
+	In    io.ByteReader
+	Out   io.ByteWriter
+}
+
+// Stop is the error returned when translated code halts or faults.
+type Stop struct {
+	Reason string
+	Ip     uint16
+}
+
+func (s *Stop) Error() string {
+	return fmt.Sprintf("%v at %v", s.Reason, s.Ip)
+}
+
+func (m *Machine) recover(err *error) {
+	if r := recover(); r != nil {
+		if stop, ok := r.(*Stop); ok {
+			*err = stop
+			return
+		}
+		*err = fmt.Errorf("%v", r)
+	}
+}
+
+func (m *Machine) pop(ip uint16) uint16 {
+	if len(m.Stack) == 0 {
+		panic(&Stop{"stack underflow", ip})
+	}
+	v := m.Stack[len(m.Stack)-1]
+	m.Stack = m.Stack[:len(m.Stack)-1]
+	return v
+}
+
+func (m *Machine) ret(ip uint16) uint16 {
+	if len(m.Stack) == 0 {
+		panic(&Stop{"halt", ip})
+	}
+	return m.pop(ip)
+}
+
+func (m *Machine) in(ip uint16) uint16 {
+	b, err := m.In.ReadByte()
+	if err != nil {
+		panic(&Stop{err.Error(), ip})
+	}
+	return uint16(b)
+}
+`
+
+type translator struct {
+	vm    *VM
+	funcs map[uint16]*tfunc
+	queue []uint16
+}
+
+type tinstr struct {
+	ip   uint16
+	in   instr
+	bad  bool
+	next int
+}
+
+type tfunc struct {
+	entry    uint16
+	code     map[uint16]*tinstr
+	targets  map[uint16]bool
+	indirect bool
+}
+
+// discover finds the instructions reachable from entry without crossing a
+// Call, queueing every literal call target for translation.
+func (t *translator) discover(entry uint16) *tfunc {
+	f := &tfunc{entry: entry, code: map[uint16]*tinstr{}, targets: map[uint16]bool{}}
+	work := []uint16{entry}
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		if f.code[ip] != nil {
+			continue
+		}
+		ti := t.decode(ip)
+		f.code[ip] = ti
+		if ti.bad {
+			continue
+		}
+		name := Ops[ti.in.op].Name
+		w := ti.in.words
+		switch name {
+		case "Jmp":
+			if w[0] > 32767 {
+				f.indirect = true
+			} else {
+				f.targets[w[0]] = true
+				work = append(work, w[0])
+			}
+		case "JT", "JF":
+			if w[1] > 32767 {
+				f.indirect = true
+			} else {
+				f.targets[w[1]] = true
+				work = append(work, w[1])
+			}
+		case "Call":
+			if w[0] <= 32767 {
+				t.queue = append(t.queue, w[0])
+			}
+		}
+		switch name {
+		case "Jmp", "Ret", "Halt":
+		default:
+			if ti.next < MemSize {
+				work = append(work, uint16(ti.next))
+			}
+		}
+	}
+	return f
+}
+
+func (t *translator) decode(ip uint16) *tinstr {
+	ti := &tinstr{ip: ip}
+	in, err := t.vm.decodeInstr(ip)
+	if err != nil {
+		ti.bad = true
+		return ti
+	}
+	ti.in = in
+	ti.next = int(ip) + int(in.size)
+	return ti
+}
+
+// fallsThrough reports whether execution can continue at ti.next.
+func (ti *tinstr) fallsThrough() bool {
+	if ti.bad {
+		return false
+	}
+	switch Ops[ti.in.op].Name {
+	case "Jmp", "Ret", "Halt":
+		return false
+	}
+	return true
+}
+
+func (t *translator) emit(w io.Writer, f *tfunc) {
+	var addrs []int
+	for addr := range f.code {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	labels := map[uint16]bool{}
+	for target := range f.targets {
+		labels[target] = true
+	}
+	if addrs[0] != int(f.entry) {
+		labels[f.entry] = true
+	}
+	for i, addr := range addrs {
+		ti := f.code[uint16(addr)]
+		if ti.fallsThrough() && ti.next < MemSize && (i+1 >= len(addrs) || addrs[i+1] != ti.next) {
+			labels[uint16(ti.next)] = true
+		}
+	}
+	fmt.Fprintf(w, "\nfunc (m *Machine) f%v() uint16 {\n", f.entry)
+	if addrs[0] != int(f.entry) {
+		fmt.Fprintf(w, "goto L%v\n", f.entry)
+	}
+	for i, addr := range addrs {
+		ti := f.code[uint16(addr)]
+		if labels[ti.ip] || f.indirect {
+			fmt.Fprintf(w, "L%v:\n", ti.ip)
+		}
+		t.emitInstr(w, f, ti)
+		if ti.fallsThrough() && ti.next >= MemSize {
+			// Running off the end of memory is a fault, as in step.
+			fmt.Fprintf(w, "panic(&Stop{\"bad address\", %v})\n", ti.next)
+		} else if ti.fallsThrough() && (i+1 >= len(addrs) || addrs[i+1] != ti.next) {
+			fmt.Fprintf(w, "goto L%v\n", ti.next)
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func (t *translator) val(w uint16) string {
+	if w > 32767 {
+		return fmt.Sprintf("m.R[%v]", w-32768)
+	}
+	return fmt.Sprintf("%v", w)
+}
+
+func (t *translator) dst(ti *tinstr) string {
+	w := ti.in.words[0]
+	if w > 32767 {
+		return fmt.Sprintf("m.R[%v]", w-32768)
+	}
+	return fmt.Sprintf("m.Mem[%v]", ti.in.dest)
+}
+
+// constant evaluates an instruction whose sources are all literals with the
+// Ops table itself.
+func (t *translator) constant(ti *tinstr) (string, bool) {
+	op := Ops[ti.in.op]
+	var d uint16
+	a := []*uint16{&d}
+	for i := 1; i < len(op.Args); i++ {
+		w := ti.in.words[i]
+		if w > 32767 {
+			return "", false
+		}
+		a = append(a, &w)
+	}
+	if err := op.Function(&VM{}, a); err != nil {
+		return fmt.Sprintf("panic(&Stop{%q, %v})", err.Error(), ti.ip), true
+	}
+	return fmt.Sprintf("%v = %v", t.dst(ti), d), true
+}
+
+func (t *translator) jump(f *tfunc, w uint16) string {
+	if w > 32767 {
+		var cases []string
+		addrs := make([]int, 0, len(f.code))
+		for addr := range f.code {
+			addrs = append(addrs, int(addr))
+		}
+		sort.Ints(addrs)
+		for _, addr := range addrs {
+			cases = append(cases, fmt.Sprintf("case %v:\ngoto L%v\n", addr, addr))
+		}
+		s := fmt.Sprintf("switch %v {\n", t.val(w))
+		for _, c := range cases {
+			s += c
+		}
+		return s + fmt.Sprintf("default:\npanic(&Stop{\"indirect jump\", %v})\n}", t.val(w))
+	}
+	return fmt.Sprintf("goto L%v", w)
+}
+
+func (t *translator) call(ti *tinstr) string {
+	w := ti.in.words[0]
+	check := func(callee string) string {
+		return fmt.Sprintf("m.Stack = append(m.Stack, %v)\nif %v != %v {\npanic(&Stop{\"bad return\", %v})\n}",
+			ti.next, callee, ti.next, ti.ip)
+	}
+	if w <= 32767 {
+		return check(fmt.Sprintf("m.f%v()", w))
+	}
+	var addrs []int
+	for addr := range t.funcs {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	s := fmt.Sprintf("switch %v {\n", t.val(w))
+	for _, addr := range addrs {
+		s += fmt.Sprintf("case %v:\n%v\n", addr, check(fmt.Sprintf("m.f%v()", addr)))
+	}
+	return s + fmt.Sprintf("default:\npanic(&Stop{\"indirect call\", %v})\n}", ti.ip)
+}
+
+func (t *translator) emitInstr(w io.Writer, f *tfunc, ti *tinstr) {
+	if ti.bad {
+		fmt.Fprintf(w, "panic(&Stop{\"bad op\", %v})\n", ti.ip)
+		return
+	}
+	op := Ops[ti.in.op]
+	a := ti.in.words
+	fmt.Fprintf(w, "// %v %v\n", ti.ip, op.Name)
+	switch op.Name {
+	case "Set", "Eq", "Gt", "Add", "Mult", "Mod", "And", "Or", "Not":
+		if s, ok := t.constant(ti); ok {
+			fmt.Fprintf(w, "%v\n", s)
+			return
+		}
+	}
+	d := t.dst(ti)
+	switch op.Name {
+	case "Halt":
+		fmt.Fprintf(w, "panic(&Stop{\"halt\", %v})\n", ti.ip)
+	case "Set":
+		fmt.Fprintf(w, "%v = %v\n", d, t.val(a[1]))
+	case "Push":
+		fmt.Fprintf(w, "m.Stack = append(m.Stack, %v)\n", t.val(a[0]))
+	case "Pop":
+		fmt.Fprintf(w, "%v = m.pop(%v)\n", d, ti.ip)
+	case "Eq":
+		fmt.Fprintf(w, "if %v == %v {\n%v = 1\n} else {\n%v = 0\n}\n", t.val(a[1]), t.val(a[2]), d, d)
+	case "Gt":
+		fmt.Fprintf(w, "if %v > %v {\n%v = 1\n} else {\n%v = 0\n}\n", t.val(a[1]), t.val(a[2]), d, d)
+	case "Jmp":
+		fmt.Fprintf(w, "%v\n", t.jump(f, a[0]))
+	case "JT":
+		fmt.Fprintf(w, "if %v != 0 {\n%v\n}\n", t.val(a[0]), t.jump(f, a[1]))
+	case "JF":
+		fmt.Fprintf(w, "if %v == 0 {\n%v\n}\n", t.val(a[0]), t.jump(f, a[1]))
+	case "Add":
+		fmt.Fprintf(w, "%v = (%v + %v) %% 32768\n", d, t.val(a[1]), t.val(a[2]))
+	case "Mult":
+		fmt.Fprintf(w, "%v = (%v * %v) %% 32768\n", d, t.val(a[1]), t.val(a[2]))
+	case "Mod":
+		if a[2] == 0 {
+			fmt.Fprintf(w, "panic(&Stop{\"divide by zero\", %v})\n", ti.ip)
+			break
+		}
+		if a[2] > 32767 {
+			fmt.Fprintf(w, "if %v == 0 {\npanic(&Stop{\"divide by zero\", %v})\n}\n", t.val(a[2]), ti.ip)
+		}
+		fmt.Fprintf(w, "%v = (%v %% %v) %% 32768\n", d, t.val(a[1]), t.val(a[2]))
+	case "And":
+		fmt.Fprintf(w, "%v = (%v & %v) & 0x7FFF\n", d, t.val(a[1]), t.val(a[2]))
+	case "Or":
+		fmt.Fprintf(w, "%v = (%v | %v) & 0x7FFF\n", d, t.val(a[1]), t.val(a[2]))
+	case "Not":
+		fmt.Fprintf(w, "%v = (^%v) & 0x7FFF\n", d, t.val(a[1]))
+	case "RMem":
+		fmt.Fprintf(w, "%v = m.Mem[%v]\n", d, t.val(a[1]))
+	case "WMem":
+		fmt.Fprintf(w, "m.Mem[%v] = %v\n", t.val(a[0]), t.val(a[1]))
+	case "Call":
+		fmt.Fprintf(w, "%v\n", t.call(ti))
+	case "Ret":
+		fmt.Fprintf(w, "return m.ret(%v)\n", ti.ip)
+	case "Out":
+		fmt.Fprintf(w, "m.Out.WriteByte(byte(%v))\n", t.val(a[0]))
+	case "In":
+		fmt.Fprintf(w, "%v = m.in(%v)\n", d, ti.ip)
+	case "Noop":
+	}
+}
@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const translateDriver = `package main
+
+import "fmt"
+
+func main() {
+	for _, r := range [][3]uint16{%v} {
+		m := &Machine{Mem: make([]uint16, 32768)}
+		m.R[0], m.R[1], m.R[7] = r[0], r[1], r[2]
+		err := m.Call6027()
+		fmt.Println(m.R[0], m.R[1], err)
+	}
+}
+`
+
+func TestTranslate6027(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip(err)
+	}
+	v := &VM{}
+	if err := v.Load("../../challenge.bin"); err != nil {
+		t.Skip(err)
+	}
+	inputs := [][3]uint16{{1, 1, 1}, {2, 3, 5}, {3, 1, 2}, {3, 2, 1}}
+	var want, literals []string
+	for _, in := range inputs {
+		r := call6027(t, nil, in[0], in[1], in[2])
+		want = append(want, fmt.Sprintf("%v %v <nil>", r.Registers[0], r.Registers[1]))
+		literals = append(literals, fmt.Sprintf("{%v, %v, %v}", in[0], in[1], in[2]))
+	}
+
+	dir := t.TempDir()
+	var src bytes.Buffer
+	if err := v.Translate(&src, "main", 6027); err != nil {
+		t.Fatal(err)
+	}
+	driver := fmt.Sprintf(translateDriver, strings.Join(literals, ", "))
+	for name, text := range map[string]string{"f6027.go": src.String(), "main.go": driver} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goTool, "run", "f6027.go", "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("running translation: %v\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != strings.Join(want, "\n") {
+		t.Errorf("translated 6027 returned\n%v\ninterpreted\n%v", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestTranslateOffEnd(t *testing.T) {
+	v := &VM{Registers: make([]uint16, 8), Mem: make([]uint16, MemSize)}
+	v.Mem[MemSize-2] = 21 // noop
+	v.Mem[MemSize-1] = 21 // noop, then off the end
+	var src bytes.Buffer
+	if err := v.Translate(&src, "main", MemSize-2); err != nil {
+		t.Fatal(err)
+	}
+	if s := src.String(); strings.Contains(s, "L32768") || !strings.Contains(s, `panic(&Stop{"bad address", 32768})`) {
+		t.Errorf("translation running off the end of memory:\n%v", s)
+	}
+}
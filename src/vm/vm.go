@@ -1,15 +1,13 @@
 package vm
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
 )
 
 type Op struct {
@@ -43,6 +41,10 @@ var Ops = []Op{
 	{OpNoop, "Noop", ""},
 }
 
+// MemSize is the number of words in the 15-bit address space. Mem is always
+// this long, whatever the size of the loaded image.
+const MemSize = 32768
+
 type State struct {
 	Mem       []uint16
 	Registers []uint16
@@ -57,21 +59,83 @@ type Metadata struct {
 	WriteMem    []bool
 	ExecMem     []bool
 	Annotations map[uint16]string
+	Breakpoints map[uint16]bool
 }
 
 type VM struct {
 	State
 	meta         Metadata
 	MetadataFile string
-	ControlChan  chan string
+	Program      string
+	ControlChan  chan error
 	SaveOnEOF    bool
 	Break        map[uint16]bool
 	BreakOps     map[uint16]bool
 	Step         bool
 	Stdout       io.Writer
-	Stdin        *bufio.Reader
+	Stdin        io.Reader
+	Console      Console
+	OnPrompt     PromptFunc
+	Store        *Store
+	Head         string
 	Debugging    bool
 	Counter      int
+	JIT          bool
+	Checkpoints  int
+	Escape       string
+	Journal      int
+	code         []instr
+	codeMem      *uint16
+	codeRegs     *uint16
+	args         [3]*uint16
+	interrupted  int32
+	attached     int32
+	sigint       int32
+	blocks       []*block
+	heat         []uint8
+	covered      []bool
+	dirty        []bool
+	smc          bool
+	hooks        map[uint16]HookFunc
+	memShared    bool
+	output       []byte
+	midLine      bool
+	prompted     bool
+	mark         *Save
+	input        []byte
+	ring         []checkpoint
+	checkpointed bool
+	turn         []byte
+	pending      []byte
+	history      journal
+}
+
+// HookFunc is a Go implementation of a program function. It reads and writes
+// the machine's Registers and Stack directly, and Mem through WriteMem, and
+// when it returns nil execution continues after the Call as if the function
+// had executed Ret. Any other error stops the machine.
+type HookFunc func(vm *VM) error
+
+// WriteMem sets Mem[addr] outside of an instruction, as a hook might, taking
+// a private copy of shared memory and discarding any decoded or compiled code
+// the word is part of.
+func (vm *VM) WriteMem(addr, value uint16) {
+	vm.OwnMem()
+	vm.Mem[addr] = value
+	vm.invalidate(addr)
+}
+
+// Hook makes every Call to addr run fn instead of the code at addr. A nil fn
+// removes the hook.
+func (vm *VM) Hook(addr uint16, fn HookFunc) {
+	if fn == nil {
+		delete(vm.hooks, addr)
+		return
+	}
+	if vm.hooks == nil {
+		vm.hooks = make(map[uint16]HookFunc)
+	}
+	vm.hooks[addr] = fn
 }
 
 func (vm *VM) SaveMetadata() error {
@@ -90,17 +154,11 @@ func (vm *VM) LoadMetadata() error {
 		decoder := gob.NewDecoder(file)
 		err = decoder.Decode(&vm.meta)
 	}
-	if len(vm.meta.ReadMem) < len(vm.Mem) {
+	if len(vm.meta.ReadMem) < MemSize || len(vm.meta.WriteMem) < MemSize || len(vm.meta.ExecMem) < MemSize {
 		fmt.Printf("initilazing metadata\n")
-		rMem := make([]bool, len(vm.Mem))
-		copy(rMem, vm.meta.ReadMem)
-		vm.meta.ReadMem = rMem
-		wMem := make([]bool, len(vm.Mem))
-		copy(wMem, vm.meta.ReadMem)
-		vm.meta.WriteMem = wMem
-		eMem := make([]bool, len(vm.Mem))
-		copy(eMem, vm.meta.ExecMem)
-		vm.meta.ExecMem = eMem
+		vm.meta.ReadMem = growBools(vm.meta.ReadMem)
+		vm.meta.WriteMem = growBools(vm.meta.WriteMem)
+		vm.meta.ExecMem = growBools(vm.meta.ExecMem)
 	}
 	if vm.meta.Functions == nil {
 		vm.meta.Functions = make(map[uint16]bool)
@@ -108,28 +166,25 @@ func (vm *VM) LoadMetadata() error {
 	if vm.meta.Annotations == nil {
 		vm.meta.Annotations = make(map[uint16]string)
 	}
-	return nil
-}
-
-func (vm *VM) SaveVM(name string) error {
-	fn := fmt.Sprintf("%v-%v", name, time.Now().Format(time.RFC3339))
-	file, err := os.Create(fn)
-	if err != nil {
-		return err
+	if vm.meta.Breakpoints == nil {
+		vm.meta.Breakpoints = make(map[uint16]bool)
 	}
-	vm.Printf("saving to %v\n", fn)
-	encoder := gob.NewEncoder(file)
-	return encoder.Encode(vm.State)
+	if vm.Break == nil {
+		vm.Break = make(map[uint16]bool)
+	}
+	for addr := range vm.meta.Breakpoints {
+		vm.Break[addr] = true
+	}
+	return nil
 }
 
-func (vm *VM) LoadVM(fn string) error {
-	file, err := os.Open(fn)
-	if err != nil {
-		return fmt.Errorf("%v \"%v\"", err, fn)
+func growBools(b []bool) []bool {
+	if len(b) >= MemSize {
+		return b
 	}
-	decoder := gob.NewDecoder(file)
-	return decoder.Decode(&vm.State)
-
+	g := make([]bool, MemSize)
+	copy(g, b)
+	return g
 }
 
 func (vm *VM) Load(fn string) error {
@@ -140,40 +195,23 @@ func (vm *VM) Load(fn string) error {
 	if err != nil {
 		return err
 	}
-	fileinfo, err := file.Stat()
+	defer file.Close()
+	image, err := ioutil.ReadAll(file)
 	if err != nil {
 		return err
 	}
-	if fileinfo.Size()%2 == 1 {
+	if len(image)%2 == 1 {
 		return fmt.Errorf("corrupt program file")
 	}
-	vm.Mem = make([]uint16, fileinfo.Size()/2)
-	err = binary.Read(file, binary.LittleEndian, vm.Mem)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (vm *VM) value(v uint16) uint16 {
-	if v <= 32767 {
-		return v
-	}
-	if v >= 32776 {
-		panic("value out of range")
-	}
-	return vm.Registers[v-32768]
-}
-
-func (vm *VM) dest(d uint16) *uint16 {
-	if d <= 32767 {
-		vm.meta.WriteMem[d] = true
-		return &vm.Mem[d]
-	}
-	if d >= 32776 {
-		panic("dest out of range")
+	if len(image)/2 > MemSize {
+		return fmt.Errorf("program file too large")
 	}
-	return &vm.Registers[d-32768]
+	vm.Invalidate()
+	vm.Mem = make([]uint16, MemSize)
+	vm.memShared = false
+	vm.Program = programHash(image)
+	vm.Counter = 0
+	return binary.Read(bytes.NewReader(image), binary.LittleEndian, vm.Mem[:len(image)/2])
 }
 
 func mod(v uint16) uint16 {
@@ -181,7 +219,7 @@ func mod(v uint16) uint16 {
 }
 
 func OpHalt(vm *VM, a []*uint16) error {
-	return fmt.Errorf("halt")
+	return Halted
 }
 
 func OpSet(vm *VM, a []*uint16) error {
@@ -194,6 +232,9 @@ func OpPush(vm *VM, a []*uint16) error {
 	return nil
 }
 func OpPop(vm *VM, a []*uint16) error {
+	if len(vm.Stack) == 0 {
+		return StackUnderflow
+	}
 	*a[0] = vm.Stack[len(vm.Stack)-1]
 	vm.Stack = vm.Stack[:len(vm.Stack)-1]
 	return nil
@@ -247,6 +288,9 @@ func OpMult(vm *VM, a []*uint16) error {
 }
 
 func OpMod(vm *VM, a []*uint16) error {
+	if *a[2] == 0 {
+		return DivideByZero
+	}
 	*a[0] = mod(*a[1] % *a[2])
 	return nil
 }
@@ -267,18 +311,34 @@ func OpNot(vm *VM, a []*uint16) error {
 }
 
 func OpRMem(vm *VM, a []*uint16) error {
+	if int(*a[1]) >= len(vm.Mem) {
+		return BadAddress
+	}
 	*a[0] = vm.Mem[*a[1]]
 	return nil
 }
 
 func OpWMem(vm *VM, a []*uint16) error {
-	vm.meta.WriteMem[*a[0]] = true
+	if int(*a[0]) >= len(vm.Mem) {
+		return BadAddress
+	}
+	if vm.meta.WriteMem != nil {
+		vm.meta.WriteMem[*a[0]] = true
+	}
+	vm.OwnMem()
 	vm.Mem[*a[0]] = *a[1]
+	vm.invalidate(*a[0])
 	return nil
 }
 
 func OpCall(vm *VM, a []*uint16) error {
-	vm.meta.Functions[*a[0]] = true
+	if vm.meta.Functions != nil {
+		vm.meta.Functions[*a[0]] = true
+	}
+	if hook := vm.hooks[*a[0]]; hook != nil {
+		vm.OwnMem()
+		return hook(vm)
+	}
 	vm.CallStack = append(vm.CallStack, *a[0], vm.Ip-2)
 	vm.Stack = append(vm.Stack, vm.Ip)
 	vm.Ip = *a[0]
@@ -287,7 +347,7 @@ func OpCall(vm *VM, a []*uint16) error {
 
 func OpRet(vm *VM, a []*uint16) error {
 	if len(vm.Stack) == 0 {
-		return fmt.Errorf("halt")
+		return Halted
 	}
 	vm.Ip = vm.Stack[len(vm.Stack)-1]
 	vm.Stack = vm.Stack[:len(vm.Stack)-1]
@@ -298,17 +358,33 @@ func OpRet(vm *VM, a []*uint16) error {
 }
 
 func OpOut(vm *VM, a []*uint16) error {
-	fmt.Fprintf(vm.Stdout, "%v", string([]byte{byte(*a[0])}))
-	return nil
+	if vm.OnPrompt != nil {
+		vm.output = append(vm.output, byte(*a[0]))
+	}
+	if vm.Checkpoints > 0 {
+		vm.turn = append(vm.turn, byte(*a[0]))
+	}
+	return vm.console().WriteByte(byte(*a[0]))
 }
 
 func OpIn(vm *VM, a []*uint16) error {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(vm.Stdin, buf)
+	if vm.Checkpoints > 0 && !vm.midLine && !vm.checkpointed {
+		vm.checkpoint()
+	}
+	if err := vm.prompt(); err != nil {
+		return err
+	}
+	c, err := vm.readInput()
 	if err != nil {
 		return err
 	}
-	*a[0] = uint16(buf[0])
+	vm.prompted = false
+	vm.checkpointed = false
+	vm.midLine = c != '\n'
+	if vm.Store != nil {
+		vm.input = append(vm.input, c)
+	}
+	*a[0] = uint16(c)
 	return nil
 }
 
@@ -333,13 +409,13 @@ func (vm *VM) Start() {
 	vm.Printf("Recieved state\n")
 	<-vm.ControlChan
 	vm.Printf("signaling ready\n")
-	vm.ControlChan <- ""
+	vm.ControlChan <- nil
 }
 
 func (vm *VM) Finish() error {
 	err := <-vm.ControlChan
-	vm.ControlChan <- ""
-	return fmt.Errorf("%v", err)
+	vm.ControlChan <- nil
+	return err
 }
 
 type decodedOp struct {
@@ -369,6 +445,9 @@ func (vm *VM) Decode(p *uint16, verbose bool) (*decodedOp, bool) {
 	for _, arg := range dop.Op.Args {
 		var v *uint16
 		var d string
+		if int(*p) >= len(vm.Mem) {
+			return &dop, false
+		}
 		m := &vm.Mem[*p]
 		dop.Codes = append(dop.Codes, *m)
 		if *m >= 32776 {
@@ -396,6 +475,9 @@ func (vm *VM) Decode(p *uint16, verbose bool) (*decodedOp, bool) {
 			}
 		} else {
 			if *m <= 32767 {
+				if int(*m) >= len(vm.Mem) {
+					return &dop, false
+				}
 				v = &vm.Mem[*m]
 				if verbose {
 					d = fmt.Sprintf("*%v", *m)
@@ -421,77 +503,6 @@ func (vm *VM) Decode(p *uint16, verbose bool) (*decodedOp, bool) {
 	return &dop, true
 }
 
-func (vm *VM) Run() {
-
-	saveSigChan := make(chan os.Signal, 1)
-	signal.Notify(saveSigChan, syscall.SIGUSR1)
-
-	dbgSigChan := make(chan os.Signal, 1)
-	if vm.Debugging {
-
-		signal.Notify(dbgSigChan, syscall.SIGINT)
-	}
-	vm.Counter = 0
-	vm.ControlChan <- "break"
-	_, ok := <-vm.ControlChan
-	if !ok {
-		return
-	}
-	for {
-		vm.Counter++
-		opIp := vm.Ip
-		var err error
-		var receivedDbgSig bool
-		select {
-		case <-saveSigChan:
-			vm.SaveVM("SIG")
-		case sig := <-dbgSigChan:
-			vm.Printf("SIGNAL RECEIVED %v\n", sig)
-			receivedDbgSig = true
-		default:
-		}
-		if vm.BreakOps[vm.Mem[vm.Ip]] || vm.Step || vm.Break[vm.Ip] || receivedDbgSig {
-			vm.ControlChan <- "break"
-			_, ok := <-vm.ControlChan
-			if !ok {
-				return
-			}
-		}
-		vm.meta.ExecMem[vm.Ip] = true
-		dOp, good := vm.Decode(&vm.Ip, false)
-		if !good {
-			vm.ControlChan <- fmt.Sprintf("bad op %v at %v", dOp.Codes[0], opIp)
-			<-vm.ControlChan
-			return
-		}
-		err = dOp.Function(vm, dOp.Args)
-		if err != nil {
-			if err.Error() == "halt" {
-				vm.ControlChan <- "halt"
-				<-vm.ControlChan
-				return
-			} else if err == io.EOF {
-				if vm.Debugging {
-					vm.Ip = opIp
-					vm.Step = true
-					continue
-				}
-				if vm.SaveOnEOF {
-					vm.Ip = opIp
-					vm.SaveVM("EOF")
-				}
-				vm.ControlChan <- "eof"
-				<-vm.ControlChan
-				return
-			} else {
-				vm.ControlChan <- err.Error()
-				<-vm.ControlChan
-				return
-			}
-		}
-	}
-}
-
 func (vm *VM) Printf(format string, a ...interface{}) (int, error) {
-	return fmt.Fprintf(vm.Stdout, format, a...)
+	return fmt.Fprintf(vm.console(), format, a...)
 }
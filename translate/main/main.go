@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"vm"
+)
+
+func main() {
+
+	savedGame := flag.Bool("save", false, "load a saved vm instead of the program")
+	entry := flag.Int("func", 6027, "address of the function to translate")
+	pkg := flag.String("pkg", "main", "package name of the generated source")
+	output := flag.String("o", "", "file to write the generated source to")
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		fmt.Printf("usage translate [-save] [-func <addr>] [-pkg <name>] [-o <file.go>] <program.bin>\n")
+		os.Exit(1)
+	}
+	v := &vm.VM{
+		Stdout: os.Stderr,
+	}
+	var err error
+	if *savedGame {
+		err = v.LoadVM(flag.Arg(0))
+	} else {
+		err = v.Load(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Printf("load failed %v\n", err)
+		os.Exit(1)
+	}
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	}
+	err = v.Translate(out, *pkg, uint16(*entry))
+	if err != nil {
+		fmt.Printf("translate failed %v\n", err)
+		os.Exit(1)
+	}
+}
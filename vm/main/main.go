@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
@@ -9,41 +8,69 @@ import (
 	"vm"
 )
 
-func main() {
+const usage = `usage vm [flags] <program.bin>
+Ctrl-C pauses the program in the debugger, where c resumes it and q quits.
+A second Ctrl-C before it resumes, while stopped or waiting for a line of
+input, exits. SIGUSR1 saves the game and carries on.
+`
 
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
 	savedGame := flag.Bool("save", false, "load a saved vm instead of the program")
 	saveOnEOF := flag.Bool("saveOnEOF", false, "save the game at input eof")
 	metadataFile := flag.String("metadata", ".metadata", "file of general metadata to update")
 	debug := flag.Bool("debug", false, "run in debug mode")
+	jit := flag.Bool("jit", false, "compile hot basic blocks instead of interpreting them")
 	input := flag.String("in", "", "file to use as vm input")
+	storeDir := flag.String("store", "", "snapshot store to save to, and with -save to load from")
+	escape := flag.String("escape", "!", "prefix of input lines that are commands to the vm, such as !save <name>, !load <save>, !regs, !dbg and !undo; empty for none")
+	journal := flag.Int("journal", 0, "number of instructions recorded for the debugger's rs, rc and who commands, 0 for none")
+	undo := flag.Int("undo", 100, "number of turns kept for !undo [<turns>], 0 for none")
 	flag.Parse()
 	var err error
 	var inFile io.Reader
-	if input != nil {
+	if *input == "" {
 		inFile = os.Stdin
 	} else {
 		inFile, err = os.Open(*input)
 		if err != nil {
-			fmt.Printf("error opening input file %v %v\n", input, err)
+			fmt.Printf("error opening input file %v %v\n", *input, err)
 			os.Exit(1)
 		}
 	}
 	v := &vm.VM{
-		Stdout:       os.Stdout,
-		Stdin:        bufio.NewReader(inFile),
+		Console:      vm.NewConsole(inFile, os.Stdout),
 		SaveOnEOF:    *saveOnEOF,
 		Debugging:    *debug,
-		ControlChan:  make(chan string),
+		JIT:          *jit,
+		Checkpoints:  *undo,
+		Escape:       *escape,
+		Journal:      *journal,
+		ControlChan:  make(chan error),
 		BreakOps:     make(map[uint16]bool),
 		Break:        make(map[uint16]bool),
 		MetadataFile: *metadataFile,
 	}
 	fmt.Fprintf(os.Stderr, "flags %v\n", flag.Args())
 	if len(flag.Args()) != 1 {
-		fmt.Printf("usage vm <program.bin>\n")
+		flag.Usage()
 		os.Exit(1)
 	}
-	if *savedGame {
+	if *storeDir != "" {
+		v.Store, err = vm.OpenStore(*storeDir)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *savedGame && v.Store != nil {
+		if err = v.Checkout(flag.Arg(0)); err != nil {
+			err = v.LoadVM(flag.Arg(0))
+		}
+	} else if *savedGame {
 		err = v.LoadVM(flag.Arg(0))
 	} else {
 		err = v.Load(flag.Arg(0))
@@ -52,7 +79,7 @@ func main() {
 	if err != nil {
 		fmt.Printf("load failed %v\n", err)
 	}
-	go v.Run()
+	go v.Serve()
 	if v.Debugging {
 		fmt.Printf("starting debugger\n")
 		err = v.Debug()
@@ -60,8 +87,10 @@ func main() {
 		fmt.Printf("starting\n")
 		v.Start()
 		fmt.Printf("waiting to finish\n")
-		err = v.Finish()
+		// A breakpoint, such as from !dbg, drops into the debugger.
+		err = v.Debug()
 	}
 	fmt.Printf("program finished %v after %v instructions\n", err, v.Counter)
 	v.SaveMetadata()
+	v.Flush()
 }